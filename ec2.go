@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const imdsTokenTTL = 6 * time.Hour
+
+/*
+short names for common metadata paths, most of the same arguments as:
+https://aws.amazon.com/code/ec2-instance-metadata-query-tool/
+*/
+var ec2MetadataAliases = map[string]string{
+	"ami-id":            "meta-data/ami-id",
+	"user-data":         "user-data",
+	"instance-id":       "meta-data/instance-id",
+	"instance-type":     "meta-data/instance-type",
+	"ami-launch-index":  "meta-data/ami-launch-index",
+	"availability-zone": "meta-data/placement/availability-zone",
+	"identity-document": "dynamic/instance-identity/document",
+}
+
+/*
+imdsClient talks to the EC2 instance metadata service. It uses an IMDSv2
+session token when one can be obtained and falls back to IMDSv1 otherwise.
+*/
+type imdsClient struct {
+	endpoint string
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var imds = newIMDSClient("http://169.254.169.254")
+
+func newIMDSClient(endpoint string) *imdsClient {
+	return &imdsClient{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+// getToken returns a cached session token, or "" if IMDSv2 is unavailable
+func (c *imdsClient) getToken(refresh bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !refresh && time.Now().Before(c.expires) {
+		return c.token
+	}
+
+	// whatever the outcome, don't ask again until the ttl is nearly up
+	c.token = ""
+	c.expires = time.Now().Add(imdsTokenTTL - time.Minute)
+
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprint(int(imdsTokenTTL.Seconds())))
+
+	r, err := c.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return ""
+	}
+
+	c.token = string(bs)
+	return c.token
+}
+
+func (c *imdsClient) get(path string) ([]byte, error) {
+	r, err := c.do(path, c.getToken(false))
+	if err != nil {
+		return nil, err
+	}
+
+	// the token expired or was revoked
+	if r.StatusCode == http.StatusUnauthorized {
+		r.Body.Close()
+		if r, err = c.do(path, c.getToken(true)); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", path, r.Status)
+	}
+
+	return ioutil.ReadAll(r.Body)
+}
+
+func (c *imdsClient) do(path string, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+"/latest/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	return c.client.Do(req)
+}
+
+/*
+ec2Metadata fetches any instance metadata path, e.g. "iam/info" or
+"meta-data/network/interfaces/macs/". Paths are relative to meta-data/ unless
+they start with meta-data/, user-data or dynamic/. JSON documents such as
+"identity-document" are returned as maps, everything else as a string.
+*/
+func ec2Metadata(path string) (interface{}, error) {
+	if path == "region" {
+		return ec2Region()
+	}
+
+	if p, ok := ec2MetadataAliases[path]; ok {
+		path = p
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(path, "meta-data/") && !strings.HasPrefix(path, "dynamic/") && path != "user-data" {
+		path = "meta-data/" + path
+	}
+
+	bs, err := imds.get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		var m map[string]interface{}
+		if err := json.Unmarshal(bs, &m); err == nil {
+			return m, nil
+		}
+	}
+
+	return string(bs), nil
+}
+
+// ec2Region returns AWS_REGION or the region the instance is running in
+func ec2Region() (string, error) {
+	if v := os.Getenv("AWS_REGION"); v != "" {
+		return v, nil
+	}
+
+	bs, err := imds.get("meta-data/placement/availability-zone")
+	if err != nil {
+		return "", err
+	}
+	if len(bs) == 0 {
+		return "", fmt.Errorf("empty availability zone")
+	}
+
+	return string(bs[:len(bs)-1]), nil
+}
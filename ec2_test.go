@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testToken = "testtoken"
+
+// imdsTestServer serves metadata, only accepting requests with a token if v2
+func imdsTestServer(v2 bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if !v2 || r.Method != http.MethodPut {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(testToken))
+			return
+		}
+
+		if v2 && r.Header.Get("X-aws-ec2-metadata-token") != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-1234567890abcdef0"))
+		case "/latest/meta-data/placement/availability-zone":
+			w.Write([]byte("us-west-2b"))
+		case "/latest/dynamic/instance-identity/document":
+			w.Write([]byte(`{"region": "us-west-2", "accountId": "123456789012"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func withIMDS(t *testing.T, v2 bool, f func()) {
+	ts := imdsTestServer(v2)
+	defer ts.Close()
+
+	orig := imds
+	imds = newIMDSClient(ts.URL)
+	defer func() { imds = orig }()
+
+	f()
+}
+
+func TestEC2MetadataV1(t *testing.T) {
+	withIMDS(t, false, func() {
+		v, err := ec2Metadata("instance-id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "i-1234567890abcdef0" {
+			t.Errorf("%v is not equal to %v", v, "i-1234567890abcdef0")
+		}
+	})
+
+}
+
+func TestEC2MetadataV2(t *testing.T) {
+	withIMDS(t, true, func() {
+		v, err := ec2Metadata("/meta-data/instance-id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "i-1234567890abcdef0" {
+			t.Errorf("%v is not equal to %v", v, "i-1234567890abcdef0")
+		}
+
+		// an expired token is refreshed
+		imds.token = "expired"
+		if _, err := ec2Metadata("instance-id"); err != nil {
+			t.Error(err)
+		}
+	})
+
+}
+
+func TestEC2MetadataDocument(t *testing.T) {
+	withIMDS(t, true, func() {
+		v, err := ec2Metadata("identity-document")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%v is not a map", v)
+		}
+		if m["accountId"] != "123456789012" {
+			t.Errorf("%v is not equal to %v", m["accountId"], "123456789012")
+		}
+	})
+
+}
+
+func TestEC2MetadataNotFound(t *testing.T) {
+	withIMDS(t, true, func() {
+		if _, err := ec2Metadata("tags/instance/Name"); err == nil {
+			t.Error("missing metadata path should be an error")
+		}
+	})
+
+}
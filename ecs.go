@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ecsMetadataURI returns the base url of the ECS task metadata endpoint
+func ecsMetadataURI() (string, error) {
+	for _, k := range []string{"ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"} {
+		if v := os.Getenv(k); v != "" {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("not running on ECS, ECS_CONTAINER_METADATA_URI_V4 is not set")
+}
+
+/*
+ecsMetadata fetches a path relative to the ECS task metadata endpoint, e.g.
+"" for the container metadata, "task" or "task/stats", and returns the
+decoded JSON document.
+*/
+func ecsMetadata(path string) (interface{}, error) {
+	uri, err := ecsMetadataURI()
+	if err != nil {
+		return nil, err
+	}
+
+	url := uri
+	if path = strings.Trim(path, "/"); path != "" {
+		url += "/" + path
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	r, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", url, r.Status)
+	}
+
+	var v interface{}
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("%v: %v", url, err)
+	}
+
+	return v, nil
+}
+
+// ecsTaskMetadata fetches the task metadata document
+func ecsTaskMetadata() (map[string]interface{}, error) {
+	v, err := ecsMetadata("task")
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("task metadata is not an object")
+	}
+
+	return m, nil
+}
+
+/*
+ecsTask returns the commonly needed fields of the task and container
+metadata: TaskARN, Cluster, Family, Revision, ContainerName,
+AvailabilityZone and IPv4Addresses (of all the task's containers).
+*/
+func ecsTask() (map[string]interface{}, error) {
+	task, err := ecsTaskMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := ecsMetadata("")
+	if err != nil {
+		return nil, err
+	}
+	container, _ := v.(map[string]interface{})
+
+	m := map[string]interface{}{
+		"TaskARN":          task["TaskARN"],
+		"Cluster":          task["Cluster"],
+		"Family":           task["Family"],
+		"Revision":         task["Revision"],
+		"AvailabilityZone": task["AvailabilityZone"],
+		"ContainerName":    container["Name"],
+	}
+
+	// containers in awsvpc mode share the task ENI, so dedupe addresses
+	ips := []string{}
+	seen := make(map[string]bool)
+	containers, _ := task["Containers"].([]interface{})
+	for _, c := range containers {
+		c, _ := c.(map[string]interface{})
+		networks, _ := c["Networks"].([]interface{})
+		for _, n := range networks {
+			n, _ := n.(map[string]interface{})
+			addrs, _ := n["IPv4Addresses"].([]interface{})
+			for _, a := range addrs {
+				if s, ok := a.(string); ok && !seen[s] {
+					seen[s] = true
+					ips = append(ips, s)
+				}
+			}
+		}
+	}
+	m["IPv4Addresses"] = ips
+
+	return m, nil
+}
+
+func ecsAvailabilityZone() (string, error) {
+	m, err := ecsTaskMetadata()
+	if err != nil {
+		return "", err
+	}
+
+	az, ok := m["AvailabilityZone"].(string)
+	if !ok || az == "" {
+		return "", fmt.Errorf("task metadata has no AvailabilityZone")
+	}
+
+	return az, nil
+}
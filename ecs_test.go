@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func ecsTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`{"Name": "app", "DockerName": "ecs-app-1"}`))
+		case "/task":
+			w.Write([]byte(`{
+				"Cluster": "default",
+				"TaskARN": "arn:aws:ecs:us-east-1:123456789012:task/default/abc",
+				"Family": "app",
+				"Revision": "3",
+				"AvailabilityZone": "us-east-1a",
+				"Containers": [
+					{"Name": "app", "Networks": [{"NetworkMode": "awsvpc", "IPv4Addresses": ["10.0.0.5"]}]},
+					{"Name": "sidecar", "Networks": [{"NetworkMode": "awsvpc", "IPv4Addresses": ["10.0.0.5"]}]}
+				]
+			}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func withECS(t *testing.T, f func()) {
+	ts := ecsTestServer()
+	defer ts.Close()
+
+	os.Setenv("ECS_CONTAINER_METADATA_URI_V4", ts.URL)
+	defer os.Unsetenv("ECS_CONTAINER_METADATA_URI_V4")
+
+	f()
+}
+
+func TestECSTask(t *testing.T) {
+	withECS(t, func() {
+		tmpl := `{{ with ecsTask }}{{ .Family }}:{{ .Revision }} {{ .ContainerName }} {{ join "," .IPv4Addresses }}{{ end }}`
+		exepcted := `app:3 app 10.0.0.5`
+		resp, err := newTpl("test", nil).renderStr(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != exepcted {
+			t.Errorf("%v is not equal to %v", resp, exepcted)
+		}
+	})
+
+}
+
+func TestECSMetadata(t *testing.T) {
+	withECS(t, func() {
+		v, err := ecsMetadata("/task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, _ := v.(map[string]interface{}); m["Cluster"] != "default" {
+			t.Errorf("%v is not equal to %v", m["Cluster"], "default")
+		}
+	})
+
+}
+
+func TestDiscoverRegionECS(t *testing.T) {
+	withECS(t, func() {
+		r, err := discoverRegion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != "us-east-1" {
+			t.Errorf("%v is not equal to %v", r, "us-east-1")
+		}
+	})
+
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// envCtxKey is the key of the environment in the context of file templates
+const envCtxKey string = "Env"
+
+/*
+env is a set of environment variables that keeps the order in which they
+were first set, so that the child process gets them in a deterministic order.
+*/
+type env struct {
+	keys []string
+	vals map[string]string
+}
+
+func newEnv() *env {
+	return &env{vals: make(map[string]string)}
+}
+
+/*
+parseEnv parses "KEY=value" entries such as those from os.Environ. Values are
+kept whole, including any "=". An entry without "=" is a variable with an
+empty value. If a key appears more than once the last value wins, as with
+getenv, but it keeps its first position.
+*/
+func parseEnv(environ []string) *env {
+	e := newEnv()
+	for _, i := range environ {
+		xs := strings.SplitN(i, "=", 2)
+		if xs[0] == "" {
+			continue
+		}
+		if len(xs) == 1 {
+			xs = append(xs, "")
+		}
+		e.set(xs[0], xs[1])
+	}
+
+	return e
+}
+
+func (e *env) get(k string) (string, bool) {
+	v, ok := e.vals[k]
+	return v, ok
+}
+
+// set sets k to v, adding it at the end if it isn't already set
+func (e *env) set(k, v string) {
+	if _, ok := e.vals[k]; !ok {
+		e.keys = append(e.keys, k)
+	}
+	e.vals[k] = v
+}
+
+// environ returns the variables as "KEY=value" entries in order
+func (e *env) environ() []string {
+	xs := make([]string, 0, len(e.keys))
+	for _, k := range e.keys {
+		xs = append(xs, k+"="+e.vals[k])
+	}
+
+	return xs
+}
+
+func (e *env) toMap() map[string]string {
+	m := make(map[string]string, len(e.vals))
+	for k, v := range e.vals {
+		m[k] = v
+	}
+
+	return m
+}
+
+/*
+renderOrder returns the variables whose values are templates, except those
+in raw, ordered so that a variable comes after any it reads with env, e.g.
+{{ env "DB_HOST" }}. A variable reading itself gets its original value, but
+any other cycle is an error.
+*/
+func (e *env) renderOrder(raw map[string]bool) ([]string, error) {
+	deps := make(map[string][]string)
+	var keys []string
+	for _, k := range e.keys {
+		if v := e.vals[k]; isTemplate(v) && !raw[k] {
+			keys = append(keys, k)
+			deps[k] = envRefs(k, v)
+		}
+	}
+
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var order, path []string
+
+	var visit func(k string) error
+	visit = func(k string) error {
+		switch state[k] {
+		case done:
+			return nil
+		case visiting:
+			for i, x := range path {
+				if x == k {
+					return fmt.Errorf("env vars reference each other: %v", strings.Join(append(path[i:], k), " -> "))
+				}
+			}
+		}
+
+		state[k] = visiting
+		path = append(path, k)
+		for _, d := range deps[k] {
+			if _, ok := deps[d]; ok && d != k {
+				if err := visit(d); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[k] = done
+		order = append(order, k)
+
+		return nil
+	}
+
+	for _, k := range keys {
+		if err := visit(k); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+/*
+render renders the values that are templates in the order of renderOrder.
+Rendered values are set in e and with os.Setenv, so that env sees them, and
+returned, along with whether any of them used a secret function. Secrets are
+masked if mask is true.
+*/
+func (e *env) render(ctx interface{}, raw map[string]bool, mask bool) (map[string]string, bool, []error) {
+	order, err := e.renderOrder(raw)
+	if err != nil {
+		return nil, false, []error{err}
+	}
+
+	rendered := make(map[string]string)
+	sensitive := false
+	var errs []error
+	for _, k := range order {
+		t := newTpl(k, ctx)
+		if mask {
+			t = t.masked()
+		}
+		rv, err := t.renderStr(e.vals[k])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if *t.sensitive {
+			sensitive = true
+		}
+		os.Setenv(k, rv)
+		e.set(k, rv)
+		rendered[k] = rv
+	}
+
+	return rendered, sensitive, errs
+}
+
+// envRefs returns the names passed as literals to env in the template s
+func envRefs(name, s string) []string {
+	t, err := template.New(name).Funcs(newTpl(name, nil).funcMap).Parse(s)
+	if err != nil {
+		// reported when the value is rendered
+		return nil
+	}
+
+	var refs []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			if len(n.Args) == 2 {
+				f, ok := n.Args[0].(*parse.IdentifierNode)
+				s, isStr := n.Args[1].(*parse.StringNode)
+				if ok && isStr && f.Ident == "env" {
+					refs = append(refs, s.Text)
+				}
+			}
+			for _, a := range n.Args {
+				walk(a)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		}
+	}
+	walk(t.Tree.Root)
+
+	return refs
+}
+
+/*
+withEnv adds the environment to the context of file templates as .Env,
+unless the vars file already has an Env key.
+*/
+func withEnv(ctx interface{}, vals map[string]string) interface{} {
+	if ctx == nil {
+		return map[string]interface{}{envCtxKey: vals}
+	}
+
+	if m, ok := ctx.(map[string]interface{}); ok {
+		if _, ok := m[envCtxKey]; !ok {
+			m[envCtxKey] = vals
+		}
+	}
+
+	return ctx
+}
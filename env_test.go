@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnv(t *testing.T) {
+	e := parseEnv([]string{
+		"JAVA_OPTS=-Dfoo=bar -Dbaz=qux",
+		"TOKEN=YWJjZA==",
+		"EMPTY=",
+		"NOVALUE",
+		"=C:=C:\\",
+		"DUP=first",
+		"PATH=/bin",
+		"DUP=second",
+	})
+
+	tests := map[string]string{
+		"JAVA_OPTS": "-Dfoo=bar -Dbaz=qux",
+		"TOKEN":     "YWJjZA==",
+		"EMPTY":     "",
+		"NOVALUE":   "",
+		"DUP":       "second",
+	}
+	for k, exepcted := range tests {
+		v, ok := e.get(k)
+		if !ok {
+			t.Errorf("%v is not set", k)
+		}
+		if v != exepcted {
+			t.Errorf("%v is not equal to %v", v, exepcted)
+		}
+	}
+
+	exepcted := []string{
+		"JAVA_OPTS=-Dfoo=bar -Dbaz=qux",
+		"TOKEN=YWJjZA==",
+		"EMPTY=",
+		"NOVALUE=",
+		"DUP=second",
+		"PATH=/bin",
+	}
+	if xs := e.environ(); !reflect.DeepEqual(xs, exepcted) {
+		t.Errorf("%v is not equal to %v", xs, exepcted)
+	}
+
+}
+
+func TestEnvSet(t *testing.T) {
+	e := newEnv()
+	e.set("B", "1")
+	e.set("A", "2")
+	e.set("B", "a=b")
+
+	exepcted := []string{"B=a=b", "A=2"}
+	if xs := e.environ(); !reflect.DeepEqual(xs, exepcted) {
+		t.Errorf("%v is not equal to %v", xs, exepcted)
+	}
+
+	if _, ok := e.get("C"); ok {
+		t.Errorf("C should not be set")
+	}
+
+}
+
+func TestEnvRefs(t *testing.T) {
+	s := `{{ env "A" }}{{ if env "B" }}{{ env "B" | upper }}{{ end }}{{ expandenv "$C" }}`
+
+	exepcted := []string{"A", "B", "B"}
+	if refs := envRefs("test", s); !reflect.DeepEqual(refs, exepcted) {
+		t.Errorf("%v is not equal to %v", refs, exepcted)
+	}
+
+}
+
+func TestRenderOrder(t *testing.T) {
+	e := parseEnv([]string{
+		`DB_URL=postgres://{{ env "DB_USER" }}@{{ env "DB_HOST" }}/db`,
+		`DB_HOST={{ env "DB_NAME" }}.internal`,
+		"DB_USER=app",
+		`DB_NAME={{ "db" }}`,
+		`PATH={{ env "PATH" }}:/opt/bin`,
+		`RAW={{ env "DB_URL" }}`,
+	})
+
+	order, err := e.renderOrder(map[string]bool{"RAW": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exepcted := []string{"DB_NAME", "DB_HOST", "DB_URL", "PATH"}
+	if !reflect.DeepEqual(order, exepcted) {
+		t.Errorf("%v is not equal to %v", order, exepcted)
+	}
+
+}
+
+func TestRenderOrderCycle(t *testing.T) {
+	e := parseEnv([]string{
+		`A={{ env "B" }}`,
+		`B={{ env "C" }}`,
+		`C={{ env "A" }}`,
+	})
+
+	_, err := e.renderOrder(nil)
+	if err == nil || !strings.Contains(err.Error(), "A -> B -> C -> A") {
+		t.Errorf("%v should contain the cycle", err)
+	}
+
+}
+
+func TestWithEnv(t *testing.T) {
+	vals := map[string]string{"A": "1"}
+
+	ctx := withEnv(nil, vals).(map[string]interface{})
+	if !reflect.DeepEqual(ctx[envCtxKey], vals) {
+		t.Errorf("%v is not equal to %v", ctx[envCtxKey], vals)
+	}
+
+	// a key from the vars file is kept
+	ctx = withEnv(map[string]interface{}{envCtxKey: "production"}, vals).(map[string]interface{})
+	if ctx[envCtxKey] != "production" {
+		t.Errorf("%v is not equal to %v", ctx[envCtxKey], "production")
+	}
+
+	s, err := newTpl("test", withEnv(nil, vals)).renderStr(`{{ .Env.A }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "1" {
+		t.Errorf("%v is not equal to %v", s, "1")
+	}
+
+}
+
+func TestEnvRenderSensitive(t *testing.T) {
+	defer os.Unsetenv("A")
+	defer os.Unsetenv("T")
+
+	withK8s(t, map[string]string{"serviceaccount/token": "token"}, func() {
+		tests := []struct {
+			environ   []string
+			sensitive bool
+		}{
+			{[]string{`A={{ "a" }}`, "B=b"}, false},
+			{[]string{`A={{ "a" }}`, `T={{ k8sToken }}`}, true},
+		}
+
+		for _, test := range tests {
+			e := parseEnv(test.environ)
+			_, sensitive, errs := e.render(nil, nil, false)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			if sensitive != test.sensitive {
+				t.Errorf("%v: %v is not equal to %v", test.environ, sensitive, test.sensitive)
+			}
+		}
+	})
+
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const frontMatterDelim string = "---"
+
+/*
+frontMatter is an optional YAML block at the top of a template, between two
+--- lines, that is removed before the template is parsed:
+
+	---
+	dest: /conf/app.conf
+	mode: 0640
+	owner: app:app
+	require: [DB_HOST, DB_PORT]
+	validate: app --check-config {{output}}
+	format: yaml
+	schema: /etc/templates/app.schema.json
+	---
+
+Settings given in ENTRYPOINT_TEMPLATES take precedence over front matter.
+*/
+type frontMatter struct {
+	Dest     string   `yaml:"dest"`
+	Mode     string   `yaml:"mode"`
+	Owner    string   `yaml:"owner"`
+	Require  []string `yaml:"require"`
+	Validate string   `yaml:"validate"`
+	Format   string   `yaml:"format"`
+	Schema   string   `yaml:"schema"`
+}
+
+/*
+splitFrontMatter returns the front matter of the template name's source src,
+if any, and the template body. The front matter is replaced by a template
+comment spanning the same lines, so that line numbers in errors still match
+the file but nothing is added to the output.
+
+A leading block is only front matter if it is a YAML mapping with at least
+one of the front matter keys, so that templates such as Markdown with its own
+front matter or SQL starting with --- comments are left as they are. Unknown
+keys next to a known one, e.g. a misspelt key, are an error.
+*/
+func splitFrontMatter(name, src string) (*frontMatter, string, error) {
+	lines := strings.SplitAfter(src, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != frontMatterDelim {
+		return nil, src, nil
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != frontMatterDelim {
+			continue
+		}
+
+		block := []byte(strings.Join(lines[1:i], ""))
+		if !hasFrontMatterKeys(block) {
+			return nil, src, nil
+		}
+
+		var fm frontMatter
+		if err := yaml.UnmarshalStrict(block, &fm); err != nil {
+			return nil, src, fmt.Errorf("%v: invalid front matter: %v", name, err)
+		}
+
+		return &fm, "{{/*" + strings.Repeat("\n", i+1) + "*/}}" + strings.Join(lines[i+1:], ""), nil
+	}
+
+	return nil, src, nil
+}
+
+// hasFrontMatterKeys reports whether the YAML mapping block has any of the keys of frontMatter
+func hasFrontMatterKeys(block []byte) bool {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(block, &m); err != nil {
+		return false
+	}
+
+	t := reflect.TypeOf(frontMatter{})
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := m[t.Field(i).Tag.Get("yaml")]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apply sets anything not already set on tpl from the front matter
+func (fm *frontMatter) apply(tpl tpl) (tpl, error) {
+	if fm.Dest != "" && !tpl.destSet {
+		tpl = tpl.withOutput(fm.Dest)
+	}
+
+	if fm.Mode != "" && tpl.mode == 0 {
+		m, err := strconv.ParseUint(fm.Mode, 8, 32)
+		if err != nil {
+			return tpl, fmt.Errorf("%v: invalid mode %v", tpl.name, fm.Mode)
+		}
+		tpl.mode = os.FileMode(m)
+	}
+
+	if fm.Owner != "" && tpl.uid == -1 && tpl.gid == -1 {
+		xs := strings.SplitN(fm.Owner, ":", 2)
+		uid, err := lookupID(xs[0], false)
+		if err != nil {
+			return tpl, fmt.Errorf("%v: %v", tpl.name, err)
+		}
+		tpl.uid = uid
+		if len(xs) == 2 {
+			if tpl.gid, err = lookupID(xs[1], true); err != nil {
+				return tpl, fmt.Errorf("%v: %v", tpl.name, err)
+			}
+		}
+	}
+
+	var missing []string
+	for _, k := range fm.Require {
+		if _, ok := os.LookupEnv(k); !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return tpl, fmt.Errorf("%v: required environment variables are not set: %v", tpl.name, strings.Join(missing, ", "))
+	}
+
+	tpl.validate = fm.Validate
+	tpl.format = fm.Format
+	tpl.schema = fm.Schema
+
+	return tpl, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	src := "---\ndest: /conf/app.conf\nmode: 0640\nrequire: [HOME]\n---\nline 6 {{ if }}\n"
+
+	fm, body, err := splitFrontMatter("test", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm == nil {
+		t.Fatal("front matter was not found")
+	}
+	if fm.Dest != "/conf/app.conf" || fm.Mode != "0640" || len(fm.Require) != 1 {
+		t.Errorf("unexpected front matter %+v", fm)
+	}
+
+	// line numbers of the body are preserved
+	_, err = newTpl("test", nil).execute(body)
+	if err == nil || !strings.Contains(err.Error(), "test:6") {
+		t.Errorf("%v should be on line 6", err)
+	}
+
+}
+
+func TestSplitFrontMatterOutput(t *testing.T) {
+	src := "---\nmode: 0755\n---\n#!/bin/sh\n  exec app\n"
+
+	_, body, _ := splitFrontMatter("test", src)
+	bs, err := newTpl("test", nil).execute(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is added before the first line
+	if exepcted := "#!/bin/sh\n  exec app\n"; string(bs) != exepcted {
+		t.Errorf("%q is not equal to %q", string(bs), exepcted)
+	}
+
+}
+
+func TestSplitFrontMatterYAML(t *testing.T) {
+	src := "---\napiVersion: v1\nkind: ConfigMap\n---\napiVersion: v1\n"
+
+	if fm, body, err := splitFrontMatter("deploy.yaml.tmpl", src); err != nil || fm != nil || body != src {
+		t.Errorf("a YAML document should not be front matter")
+	}
+
+}
+
+func TestSplitFrontMatterOther(t *testing.T) {
+	tests := map[string]string{
+		"post.md.tmpl":  "---\ntitle: Hello\n---\n# {{ .title }}\n",
+		"init.sql.tmpl": "---\n-- create the schema\n---\nCREATE TABLE t (id int);\n",
+		"empty.tmpl":    "---\n---\nbody\n",
+	}
+
+	for name, src := range tests {
+		if fm, body, err := splitFrontMatter(name, src); err != nil || fm != nil || body != src {
+			t.Errorf("%v: a block without front matter keys should be left in the body: %v", name, err)
+		}
+	}
+
+}
+
+func TestSplitFrontMatterInvalid(t *testing.T) {
+	src := "---\nowner: app\nmdoe: 0600\n---\nbody\n"
+
+	_, _, err := splitFrontMatter("app.conf.tmpl", src)
+	if err == nil || !strings.Contains(err.Error(), "app.conf.tmpl") || !strings.Contains(err.Error(), "mdoe") {
+		t.Errorf("%v should name the template and the key", err)
+	}
+
+	// and in YAML templates
+	if _, _, err := splitFrontMatter("app.yaml.tmpl", "---\nmode: 0600\nvalidat: true\n---\n"); err == nil {
+		t.Errorf("unknown keys should be an error")
+	}
+
+}
+
+func TestFrontMatterApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontmatter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "out", "app.conf")
+	src := filepath.Join(dir, "app.conf.tmpl")
+	tmpl := "---\ndest: " + dest + "\nmode: 0640\n---\n{{ hostname }}"
+	if err := ioutil.WriteFile(src, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newTpl(src, nil).renderFile(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("%v is not equal to %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+
+	// ENTRYPOINT_TEMPLATES takes precedence
+	tpls, err := expandTemplateSpec(src+":"+dir+"/spec.conf:0600", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl, _, err := tpls[0].load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpl.output != dir+"/spec.conf" || tpl.mode != 0600 {
+		t.Errorf("front matter should not override %v:%v", tpl.output, tpl.mode)
+	}
+
+}
+
+func TestFrontMatterRequire(t *testing.T) {
+	fm := &frontMatter{Require: []string{"ENTRYPOINT_TEST_UNSET"}}
+	if _, err := fm.apply(newTpl("test", nil)); err == nil {
+		t.Error("a missing required variable should be an error")
+	}
+
+}
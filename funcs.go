@@ -2,35 +2,91 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"text/template"
-	"time"
 
 	"github.com/Masterminds/sprig"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
 var sess *session.Session
+var sessErr error
+var sessOnce sync.Once
+
 var entrypointEnvVars = []string{
 	"ENTRYPOINT_VARS_FILE",
+	"ENTRYPOINT_ENV",
 	"ENTRYPOINT_TEMPLATES",
 	"ENTRYPOINT_TMPL_OPTION",
+	"ENTRYPOINT_S3_OUTPUT_DIR",
+	"ENTRYPOINT_SUPERVISE",
+	"ENTRYPOINT_RENDER_INTERVAL",
+	"ENTRYPOINT_RELOAD_SIGNAL",
+	"ENTRYPOINT_K8S_PODINFO_DIR",
+	"ENTRYPOINT_RENDER_ONLY",
+	"ENTRYPOINT_ENV_FILE",
+	"ENTRYPOINT_RAW_ENV",
 }
 
 const tmplExt string = ".tmpl"
+const tplExt string = ".tpl"
 const s3Prefix string = "s3://"
 
-func init() {
-	r := ec2Metadata("region")
-	sess = session.Must(session.NewSession(&aws.Config{Region: aws.String(r)}))
+/*
+awsSession creates the AWS session the first time an AWS function is used, so
+templates that don't touch AWS work anywhere. The region is resolved from
+AWS_REGION, AWS_DEFAULT_REGION and the shared config profile by the SDK,
+falling back to ECS task metadata and then EC2 instance metadata.
+*/
+func awsSession() (*session.Session, error) {
+	sessOnce.Do(func() {
+		s, err := session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			sessErr = err
+			return
+		}
+
+		if aws.StringValue(s.Config.Region) == "" {
+			r, err := discoverRegion()
+			if err != nil {
+				sessErr = err
+				return
+			}
+			s = s.Copy(&aws.Config{Region: aws.String(r)})
+		}
+
+		sess = s
+	})
+
+	return sess, sessErr
+}
+
+func discoverRegion() (string, error) {
+	if az, err := ecsAvailabilityZone(); err == nil {
+		return az[:len(az)-1], nil
+	}
+
+	if r, err := ec2Region(); err == nil && r != "" {
+		return r, nil
+	}
+
+	return "", fmt.Errorf("could not determine AWS region, set AWS_REGION")
 }
 
 func checkEntrypointVar(v string) bool {
@@ -43,68 +99,190 @@ func checkEntrypointVar(v string) bool {
 	return false
 }
 
+// prefixes of a secret version that select a version id or a staging label
+const secretVersionID string = "id:"
+const secretVersionStage string = "stage:"
+
 /*
-most of the same arguments as:
-https://aws.amazon.com/code/ec2-instance-metadata-query-tool/
+secretInput builds the request for a secret. An optional version is either
+"id:<version id>" or a staging label such as AWSPREVIOUS, which may also be
+written as "stage:AWSPREVIOUS".
 */
-func ec2Metadata(path string) string {
-	baseURL := "http://169.254.169.254/latest/"
-	client := &http.Client{Timeout: 3 * time.Second}
-
-	var r *http.Response
-	var err error
-
-	switch path {
-	case "ami-id":
-		r, err = client.Get(baseURL + "/meta-data/ami-id/")
-	case "user-data":
-		r, err = client.Get(baseURL + "user-data/")
-	case "instance-id":
-		r, err = client.Get(baseURL + "/meta-data/instance-id/")
-	case "instance-type":
-		r, err = client.Get(baseURL + "/meta-data/instance-type/")
-	case "ami-launch-index":
-		r, err = client.Get(baseURL + "/meta-data/ami-launch-index/")
-	case "availability-zone":
-		r, err = client.Get(baseURL + "/meta-data/placement/availability-zone/")
-	case "region":
-		if v := os.Getenv("AWS_REGION"); v != "" {
-			return v
+func secretInput(name string, version ...string) (*secretsmanager.GetSecretValueInput, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	}
+
+	switch len(version) {
+	case 0:
+	case 1:
+		v := version[0]
+		if strings.HasPrefix(v, secretVersionID) {
+			input.VersionId = aws.String(strings.TrimPrefix(v, secretVersionID))
+		} else {
+			input.VersionStage = aws.String(strings.TrimPrefix(v, secretVersionStage))
 		}
-		r, err = client.Get(baseURL + "/meta-data/placement/availability-zone/")
 	default:
-		log.Fatalf("ec2Metadata: unsupported path %s", path)
+		return nil, fmt.Errorf("%v: expected at most one version, got %v", name, version)
 	}
 
+	return input, nil
+}
+
+// secret gets a secret from Secrets Manager, either SecretString or SecretBinary
+func secret(name string, version ...string) (string, error) {
+	input, err := secretInput(name, version...)
 	if err != nil {
-		log.Fatalf("ec2Metadata: %v\n", err)
+		return "", err
 	}
 
-	bs, err := ioutil.ReadAll(r.Body)
-	if path == "region" {
-		return string(bs[:len(bs)-1])
+	sess, err := awsSession()
+	if err != nil {
+		return "", err
 	}
-	return string(bs)
-}
 
-func secret(name string) string {
 	svc := secretsmanager.New(sess)
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(name),
+	output, err := svc.GetSecretValue(input)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", name, err)
 	}
 
-	output, err := svc.GetSecretValue(input)
+	if output.SecretString != nil {
+		return *output.SecretString, nil
+	}
+
+	return string(output.SecretBinary), nil
+}
+
+// secretJSON gets a secret whose value is a JSON object
+func secretJSON(name string, version ...string) (map[string]interface{}, error) {
+	s, err := secret(name, version...)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+
+	return m, nil
+}
+
+// secretKey gets a single key of a secret whose value is a JSON object
+func secretKey(name string, key string, version ...string) (interface{}, error) {
+	m, err := secretJSON(name, version...)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := m[key]
+	if !ok {
+		return nil, fmt.Errorf("%v has no key %v", name, key)
+	}
+
+	return v, nil
+}
+
+// ssmParameter gets a parameter from SSM Parameter Store, decrypting SecureStrings
+func ssmParameter(name string) (string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return "", err
+	}
+
+	svc := ssm.New(sess)
+	input := &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	}
+
+	output, err := svc.GetParameter(input)
 	if err != nil {
-		log.Fatalf("secret: %v", err)
+		return "", fmt.Errorf("%v: %v", name, err)
 	}
 
-	return *output.SecretString
+	return *output.Parameter.Value, nil
 }
 
-func nameServers() []string {
+/*
+ssmParametersByPath gets all parameters under prefix recursively. Keys of the
+returned map are the parameter names relative to prefix, e.g. "db/host" for
+"/myapp/db/host" under "/myapp/".
+*/
+func ssmParametersByPath(prefix string) (map[string]string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	svc := ssm.New(sess)
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(prefix),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}
+
+	params := make(map[string]string)
+	err = svc.GetParametersByPathPages(input, func(o *ssm.GetParametersByPathOutput, last bool) bool {
+		for _, param := range o.Parameters {
+			k := strings.TrimPrefix(strings.TrimPrefix(*param.Name, prefix), "/")
+			params[k] = *param.Value
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", prefix, err)
+	}
+
+	return params, nil
+}
+
+// s3Object downloads an object given as s3://bucket/key
+func s3Object(url string) ([]byte, error) {
+	xs := strings.SplitN(strings.TrimPrefix(url, s3Prefix), "/", 2)
+	if len(xs) != 2 || xs[0] == "" || xs[1] == "" {
+		return nil, fmt.Errorf("%v is not a valid s3 url", url)
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	svc := s3.New(sess)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(xs[0]),
+		Key:    aws.String(xs[1]),
+	}
+
+	output, err := svc.GetObject(input)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", url, err)
+	}
+	defer output.Body.Close()
+
+	bs, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", url, err)
+	}
+
+	return bs, nil
+}
+
+// readSource reads a local file or an s3:// url
+func readSource(name string) ([]byte, error) {
+	if strings.HasPrefix(name, s3Prefix) {
+		return s3Object(name)
+	}
+
+	return ioutil.ReadFile(name)
+}
+
+func nameServers() ([]string, error) {
 	bs, err := ioutil.ReadFile("/etc/resolv.conf")
 	if err != nil {
-		log.Fatalf("nameServers: %v", err)
+		return nil, err
 	}
 
 	var ns []string
@@ -117,27 +295,55 @@ func nameServers() []string {
 		}
 	}
 
-	return ns
+	return ns, nil
 }
 
-func hostname() string {
-	s, err := os.Hostname()
-	if err != nil {
-		log.Fatalf("hostname: %v", err)
-	}
-
-	return s
+func hostname() (string, error) {
+	return os.Hostname()
 }
 
+// secretFuncs are the template functions that return sensitive values
+var secretFuncs = []string{"secret", "secretJSON", "secretKey", "ssm", "ssmPath", "k8sToken"}
+
 type tpl struct {
 	name    string
 	output  string
 	ctx     interface{}
 	opts    []string
 	funcMap map[string]interface{}
+
+	// mode of the output file, 0600 if the template or its context used a
+	// secret function and 0644 otherwise when not set. uid and gid are left
+	// unchanged when -1.
+	mode         os.FileMode
+	uid          int
+	gid          int
+	sensitive    *bool
+	sensitiveCtx bool
+
+	// destSet is true if the output was given explicitly
+	destSet bool
+	// validate is a command to check the rendered output with
+	validate string
+	// format is json, yaml, toml or none, inferred from the output if not set.
+	// schema is the path of a JSON schema the output must match.
+	format string
+	schema string
 }
 
-func newTpl(name string) tpl {
+// markSensitive wraps a template function so that calling it sets used
+func markSensitive(fn interface{}, used *bool) interface{} {
+	v := reflect.ValueOf(fn)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		*used = true
+		if v.Type().IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
+func newTpl(name string, ctx interface{}) tpl {
 	opts := []string{}
 	opt := os.Getenv("ENTRYPOINT_TMPL_OPTION")
 	switch opt {
@@ -150,49 +356,259 @@ func newTpl(name string) tpl {
 	}
 
 	funcMap := map[string]interface{}{
-		"secret":      secret,
-		"numCpu":      runtime.NumCPU,
-		"nameServers": nameServers,
-		"hostname":    hostname,
-		"ec2Metadata": ec2Metadata,
+		"secret":         secret,
+		"secretJSON":     secretJSON,
+		"secretKey":      secretKey,
+		"ssm":            ssmParameter,
+		"ssmPath":        ssmParametersByPath,
+		"numCpu":         runtime.NumCPU,
+		"nameServers":    nameServers,
+		"hostname":       hostname,
+		"ec2Metadata":    ec2Metadata,
+		"ecsMetadata":    ecsMetadata,
+		"ecsTask":        ecsTask,
+		"k8sPodName":     k8sPodName,
+		"k8sNamespace":   k8sNamespace,
+		"k8sToken":       k8sToken,
+		"k8sLabels":      k8sLabels,
+		"k8sAnnotations": k8sAnnotations,
+		"k8sOrdinal":     k8sOrdinal,
 	}
 	for k, v := range sprig.FuncMap() {
 		funcMap[k] = v
 	}
 
+	sensitive := new(bool)
+	for _, k := range secretFuncs {
+		funcMap[k] = markSensitive(funcMap[k], sensitive)
+	}
+
 	var output string
-	if _, err := os.Stat(name); err == nil {
-		output = strings.Replace(strings.Replace(name, ".tpl", "", 1), ".tmpl", "", 1)
+	if strings.HasPrefix(name, s3Prefix) {
+		// templates from s3 are rendered into ENTRYPOINT_S3_OUTPUT_DIR
+		dir := os.Getenv("ENTRYPOINT_S3_OUTPUT_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		output = filepath.Join(dir, trimExt(path.Base(name)))
+	} else if _, err := os.Stat(name); err == nil && trimExt(name) != name {
+		output = trimExt(name)
 	}
 
 	return tpl{
-		name:    name,
-		output:  output,
-		opts:    opts,
-		funcMap: funcMap,
+		name:      name,
+		output:    output,
+		ctx:       ctx,
+		opts:      opts,
+		funcMap:   funcMap,
+		uid:       -1,
+		gid:       -1,
+		sensitive: sensitive,
+	}
+}
+
+// fileMode returns the mode of the output file, which is only known after rendering
+func (tpl tpl) fileMode() os.FileMode {
+	if tpl.mode != 0 {
+		return tpl.mode
+	}
+	if *tpl.sensitive || tpl.sensitiveCtx {
+		return 0600
 	}
+
+	return 0644
+}
+
+// setOwner changes the mode and owner of f to those of the template
+func (tpl tpl) setOwner(f *os.File) error {
+	if err := f.Chmod(tpl.fileMode()); err != nil {
+		return err
+	}
+	if tpl.uid != -1 || tpl.gid != -1 {
+		return f.Chown(tpl.uid, tpl.gid)
+	}
+
+	return nil
+}
+
+/*
+withOutput sets the output path of the template to dest. If dest is a
+directory (or ends with a /) the output is written into it, named after the
+template without its extension.
+*/
+func (tpl tpl) withOutput(dest string) tpl {
+	if dest == "" {
+		return tpl
+	}
+
+	if fi, err := os.Stat(dest); strings.HasSuffix(dest, "/") || (err == nil && fi.IsDir()) {
+		dest = filepath.Join(dest, trimExt(path.Base(tpl.name)))
+	}
+
+	tpl.output = dest
+	tpl.destSet = true
+	return tpl
 }
 
-func (tpl tpl) renderFile() {
-	t := template.Must(template.New(filepath.Base(tpl.name)).Funcs(tpl.funcMap).Option(tpl.opts...).ParseFiles(tpl.name))
-	f, err := os.Create(tpl.output)
+/*
+load reads the template source and returns tpl with the template's front
+matter applied along with the template body.
+*/
+func (tpl tpl) load() (tpl, string, error) {
+	src, err := readSource(tpl.name)
 	if err != nil {
-		log.Fatalf("renderTmpl: %v", err)
+		return tpl, "", err
+	}
+
+	fm, body, err := splitFrontMatter(tpl.name, string(src))
+	if err != nil || fm == nil {
+		return tpl, body, err
 	}
-	err = t.Execute(f, nil)
+
+	tpl, err = fm.apply(tpl)
+	return tpl, body, err
+}
+
+// render reads the template source and returns the rendered output
+func (tpl tpl) render() ([]byte, error) {
+	tpl, body, err := tpl.load()
 	if err != nil {
-		log.Fatalf("renderTmpl: %v", err)
+		return nil, err
 	}
+
+	return tpl.execute(body)
 }
 
-func (tpl tpl) renderStr(s string) string {
-	t := template.Must(template.New(tpl.name).Funcs(tpl.funcMap).Option(tpl.opts...).Parse(s))
+func (tpl tpl) execute(body string) ([]byte, error) {
+	t, err := template.New(path.Base(tpl.name)).Funcs(tpl.funcMap).Option(tpl.opts...).Parse(body)
+	if err != nil {
+		return nil, err
+	}
 
 	var b bytes.Buffer
-	err := t.Execute(&b, nil)
+	if err := t.Execute(&b, tpl.ctx); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+/*
+renderFile renders the template in full and then atomically replaces the
+output file, so a failing template leaves the previous file intact.
+*/
+func (tpl tpl) renderFile() error {
+	tpl, body, err := tpl.load()
 	if err != nil {
-		log.Fatalf("renderStr: %v", err)
+		return err
+	}
+
+	if tpl.output == "" {
+		return fmt.Errorf("%v: can't determine the output file, use %v:dest", tpl.name, tpl.name)
+	}
+
+	bs, err := tpl.execute(body)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tpl.output), 0755); err != nil {
+		return err
+	}
+
+	return tpl.writeFileAtomic(bs)
+}
+
+/*
+rerender renders the template again and, if the result differs from the
+current output file, atomically replaces it. It reports whether the output
+changed.
+*/
+func (tpl tpl) rerender() (bool, error) {
+	tpl, body, err := tpl.load()
+	if err != nil {
+		return false, err
+	}
+
+	bs, err := tpl.execute(body)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := ioutil.ReadFile(tpl.output)
+	if err == nil && bytes.Equal(current, bs) {
+		return false, nil
+	}
+
+	if err := tpl.writeFileAtomic(bs); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+writeFileAtomic writes to a temporary file in the same directory as the
+output, syncs it and renames it over the output, so readers only ever see
+the previous or the new file in full.
+*/
+func (tpl tpl) writeFileAtomic(bs []byte) error {
+	if err := tpl.checkFormat(bs); err != nil {
+		return err
+	}
+
+	// keep the extension in case a validator looks at it
+	ext := filepath.Ext(tpl.output)
+	f, err := ioutil.TempFile(filepath.Dir(tpl.output), "."+strings.TrimSuffix(filepath.Base(tpl.output), ext)+".*"+ext)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := tpl.setOwner(f); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := tpl.runValidate(f.Name()); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), tpl.output); err != nil {
+		return err
+	}
+
+	// make the rename itself durable
+	d, err := os.Open(filepath.Dir(tpl.output))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (tpl tpl) renderStr(s string) (string, error) {
+	t, err := template.New(tpl.name).Funcs(tpl.funcMap).Option(tpl.opts...).Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, tpl.ctx); err != nil {
+		return "", err
 	}
 
-	return b.String()
+	return b.String(), nil
 }
@@ -1,27 +1,37 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
 const testSecret = "/mschurenko/entrypoint/test_secret"
 const testSecretValue = "mysecret"
+const testParameterPath = "/mschurenko/entrypoint/"
+const testParameter = testParameterPath + "test_parameter"
+const testParameterValue = "myparameter"
 const s3Bucket = "mschurenko-test"
 const s3Key = "fixtures/vars.yml"
 
 func TestMain(m *testing.M) {
-	r := ec2Metadata("region")
-	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(r)}))
+	sess, err := awsSession()
+	if err != nil {
+		log.Fatal(err)
+	}
 	setup(sess)
 	rc := m.Run()
 	teardown(sess)
@@ -91,6 +101,46 @@ func updateSecret(svc *secretsmanager.SecretsManager) error {
 	return err
 }
 
+func uploadFixture(svc *s3.S3) error {
+	bs, err := ioutil.ReadFile(s3Key)
+	if err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Key),
+		Body:   bytes.NewReader(bs),
+	}
+	_, err = svc.PutObject(input)
+	return err
+}
+
+func deleteFixture(svc *s3.S3) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3Key),
+	}
+	_, err := svc.DeleteObject(input)
+	return err
+}
+
+func putParameter(svc *ssm.SSM) error {
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(testParameter),
+		Value:     aws.String(testParameterValue),
+		Type:      aws.String(ssm.ParameterTypeSecureString),
+		Overwrite: aws.Bool(true),
+	}
+	_, err := svc.PutParameter(input)
+	return err
+}
+
+func deleteParameter(svc *ssm.SSM) error {
+	input := &ssm.DeleteParameterInput{Name: aws.String(testParameter)}
+	_, err := svc.DeleteParameter(input)
+	return err
+}
+
 func setup(sess *session.Session) {
 	smSvc := secretsmanager.New(sess)
 	switch secretExists(smSvc) {
@@ -111,6 +161,14 @@ func setup(sess *session.Session) {
 		}
 	}
 
+	if err := uploadFixture(s3.New(sess)); err != nil {
+		log.Fatalf("upload fixture failed: %v", err)
+	}
+
+	if err := putParameter(ssm.New(sess)); err != nil {
+		log.Fatalf("put parameter failed: %v", err)
+	}
+
 }
 
 func teardown(sess *session.Session) {
@@ -118,6 +176,12 @@ func teardown(sess *session.Session) {
 	if err := deleteSecret(svc); err != nil {
 		log.Fatalf("could not delete secret: %v\n", err)
 	}
+	if err := deleteFixture(s3.New(sess)); err != nil {
+		log.Fatalf("could not delete fixture: %v\n", err)
+	}
+	if err := deleteParameter(ssm.New(sess)); err != nil {
+		log.Fatalf("could not delete parameter: %v\n", err)
+	}
 }
 
 func TestCheckEntrypointVarValid(t *testing.T) {
@@ -138,16 +202,353 @@ func TestCheckEntrypointVarInValid(t *testing.T) {
 
 }
 
+func TestSecretInputVersion(t *testing.T) {
+	stage := "AWSPREVIOUS"
+	// custom ClientRequestTokens are version ids too
+	versionIDs := []string{"a2b7e7a4-6d3f-4b5e-9d2a-2f1c8e9b0d11", "my-release-token-2019-01-01-000000"}
+
+	for _, v := range []string{stage, "stage:" + stage} {
+		if input, _ := secretInput(testSecret, v); input.VersionStage == nil || *input.VersionStage != stage {
+			t.Errorf("%v should be used as the VersionStage", v)
+		}
+	}
+
+	for _, id := range versionIDs {
+		if input, _ := secretInput(testSecret, "id:"+id); input.VersionId == nil || *input.VersionId != id {
+			t.Errorf("%v should be used as the VersionId", id)
+		}
+	}
+
+	if _, err := secretInput(testSecret, stage, "id:"+versionIDs[0]); err == nil {
+		t.Errorf("more than one version should be an error")
+	}
+
+}
+
+func TestParseTemplateSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		ts   templateSpec
+	}{
+		{"app.conf.tmpl", templateSpec{"app.conf.tmpl", "", 0, -1, -1}},
+		{"/etc/templates/app.conf.tmpl:/conf/app.conf", templateSpec{"/etc/templates/app.conf.tmpl", "/conf/app.conf", 0, -1, -1}},
+		{"s3://bucket/app.conf.tmpl", templateSpec{"s3://bucket/app.conf.tmpl", "", 0, -1, -1}},
+		{"s3://bucket/app.conf.tmpl:/conf/", templateSpec{"s3://bucket/app.conf.tmpl", "/conf/", 0, -1, -1}},
+		{"app.conf.tmpl::0640", templateSpec{"app.conf.tmpl", "", 0640, -1, -1}},
+		{"app.conf.tmpl:/conf/app.conf:0600:1000:root", templateSpec{"app.conf.tmpl", "/conf/app.conf", 0600, 1000, 0}},
+	}
+
+	for _, tt := range tests {
+		ts, err := parseTemplateSpec(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != tt.ts {
+			t.Errorf("%v: %+v is not equal to %+v", tt.spec, ts, tt.ts)
+		}
+	}
+
+	if _, err := parseTemplateSpec("app.conf.tmpl::rw"); err == nil {
+		t.Error("rw should be an invalid mode")
+	}
+
+}
+
+func TestRenderFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withK8s(t, map[string]string{"serviceaccount/token": "token"}, func() {
+		tests := map[string]os.FileMode{
+			`{{ hostname }}`: 0644,
+			`{{ k8sToken }}`: 0600,
+		}
+
+		for tmpl, mode := range tests {
+			src := filepath.Join(dir, "test.conf.tmpl")
+			if err := ioutil.WriteFile(src, []byte(tmpl), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			tpl := newTpl(src, nil)
+			if err := tpl.renderFile(); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(tpl.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != mode {
+				t.Errorf("%v: %v is not equal to %v", tmpl, fi.Mode().Perm(), mode)
+			}
+		}
+	})
+
+}
+
+func TestRenderFileModeSensitiveCtx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "test.conf.tmpl")
+	if err := ioutil.WriteFile(src, []byte(`{{ .password }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. the vars file used secret
+	tpl := newTpl(src, map[string]interface{}{"password": "secret"})
+	tpl.sensitiveCtx = true
+	if err := tpl.renderFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(tpl.output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("%v is not equal to %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+}
+
+func TestTrimExt(t *testing.T) {
+	tests := map[string]string{
+		"app.tmpl.d/x.conf.tmpl": "app.tmpl.d/x.conf",
+		"settings.tplx":          "settings.tplx",
+		"settings.tpl":           "settings",
+	}
+
+	for name, exepcted := range tests {
+		if resp := trimExt(name); resp != exepcted {
+			t.Errorf("%v is not equal to %v", resp, exepcted)
+		}
+	}
+
+}
+
+func TestWithOutput(t *testing.T) {
+	tpl := newTpl("/etc/templates/app.conf.tmpl", nil).withOutput("/conf/")
+	if tpl.output != "/conf/app.conf" {
+		t.Errorf("%v is not equal to %v", tpl.output, "/conf/app.conf")
+	}
+
+}
+
+func TestExpandTemplateSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.conf.tmpl", "sub/b.yml.tmpl", "README"} {
+		p := filepath.Join(dir, "src", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	tests := map[string][]string{
+		src + ":" + dest: {dest + "/a.conf", dest + "/sub/b.yml"},
+		src:              {src + "/a.conf", src + "/sub/b.yml"},
+		filepath.Join(src, "*", "*.tmpl") + ":" + dest: {dest + "/sub/b.yml"},
+		filepath.Join(src, "*") + ":" + dest:           {dest + "/README", dest + "/a.conf", dest + "/sub/b.yml"},
+	}
+
+	for spec, exepcted := range tests {
+		tpls, err := expandTemplateSpec(spec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outputs []string
+		for _, tpl := range tpls {
+			outputs = append(outputs, tpl.output)
+		}
+		if strings.Join(outputs, ",") != strings.Join(exepcted, ",") {
+			t.Errorf("%v: %v is not equal to %v", spec, outputs, exepcted)
+		}
+	}
+
+}
+
+func TestExpandTemplatePaths(t *testing.T) {
+	// the owner isn't looked up when only checking paths
+	if _, err := expandTemplateSpec("app.conf.tmpl::0640:no_such_user", nil); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+	tpls, err := expandTemplatePaths("app.conf.tmpl::0640:no_such_user:no_such_group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tpls) != 1 || tpls[0].mode != 0640 || tpls[0].uid != -1 {
+		t.Errorf("unexpected templates %+v", tpls)
+	}
+
+}
+
+func TestCheckOutputs(t *testing.T) {
+	a := newTpl("a/app.conf.tmpl", nil).withOutput("/conf/app.conf")
+	b := newTpl("b/app.conf.tmpl", nil).withOutput("/conf/app.conf")
+	c := newTpl("c/app.conf.tmpl", nil)
+
+	if err := checkOutputs([]tpl{a, c}); err != nil {
+		t.Error(err)
+	}
+	if err := checkOutputs([]tpl{a, c, b}); err == nil {
+		t.Error("expected an error for templates with the same output")
+	}
+
+}
+
+func TestRenderFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "test.conf.tmpl")
+	for _, tmpl := range []string{"first", `second {{ fail "boom" }}`} {
+		if err := ioutil.WriteFile(src, []byte(tmpl), 0644); err != nil {
+			t.Fatal(err)
+		}
+		newTpl(src, nil).renderFile()
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "test.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "first" {
+		t.Errorf("%v is not equal to %v", string(bs), "first")
+	}
+
+	// only the template and its output, no temporary files
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 2 {
+		t.Errorf("expected 2 files in %v, got %v", dir, len(fis))
+	}
+
+}
+
 func TestRenderStr(t *testing.T) {
 	tmpl := `{{ mul 2 2 }}`
 	exepcted := `4`
-	resp := newTpl("test").renderStr(tmpl)
+	resp, err := newTpl("test", nil).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != exepcted {
+		t.Errorf("%v is not equal to %v\n", resp, exepcted)
+	}
+
+}
+
+func TestRenderStrFuncError(t *testing.T) {
+	tmpl := "ok\n{{ secret \"a\" \"b\" \"c\" }}"
+	_, err := newTpl("test", nil).renderStr(tmpl)
+	if err == nil {
+		t.Fatal("more than one secret version should be an error")
+	}
+
+	for _, s := range []string{"test:2", "secret", "expected at most one version"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("%v does not mention %v", err, s)
+		}
+	}
+
+}
+
+func TestRenderStrCtx(t *testing.T) {
+	tmpl := `{{ .production.web.db }}`
+	exepcted := `prod-db1`
+	ctx, err := loadVars(newTpl("fixtures/vars-no-secret.yml", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTpl("test", ctx).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if resp != exepcted {
 		t.Errorf("%v is not equal to %v\n", resp, exepcted)
 	}
 
 }
 
+func TestSelectEnv(t *testing.T) {
+	tmpl := `{{ .web.db }} {{ .web.cache }} {{ .web.port }}`
+	exepcted := `prod-db1 default-cache1 8080`
+	vars, err := loadVars(newTpl("fixtures/vars-env.yml", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := selectEnv(vars, "production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTpl("test", ctx).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != exepcted {
+		t.Errorf("%v is not equal to %v\n", resp, exepcted)
+	}
+
+}
+
+func TestLoadVarsS3(t *testing.T) {
+	tmpl := `{{ .production.web.password }}`
+	ctx, err := loadVars(newTpl(s3Prefix+s3Bucket+"/"+s3Key, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newTpl("test", ctx).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != testSecretValue {
+		t.Errorf("%v is not equal to %v\n", resp, testSecretValue)
+	}
+
+}
+
+func TestSSM(t *testing.T) {
+	tmpl := `{{ ssm "` + testParameter + `" }}`
+	resp, err := newTpl("test", nil).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != testParameterValue {
+		t.Errorf("%v is not equal to %v\n", resp, testParameterValue)
+	}
+
+}
+
+func TestSSMPath(t *testing.T) {
+	tmpl := `{{ index (ssmPath "` + testParameterPath + `") "test_parameter" }}`
+	resp, err := newTpl("test", nil).renderStr(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != testParameterValue {
+		t.Errorf("%v is not equal to %v\n", resp, testParameterValue)
+	}
+
+}
+
 func TestRenderTmpl(t *testing.T) {
 	tmplName := "test.conf.tmpl"
 
@@ -168,8 +569,10 @@ func TestRenderTmpl(t *testing.T) {
 	}
 	defer os.Remove(tmplName)
 
-	tpl := newTpl(tmplName)
-	tpl.renderFile()
+	tpl := newTpl(tmplName, nil)
+	if err := tpl.renderFile(); err != nil {
+		t.Fatal(err)
+	}
 	defer os.Remove(tpl.output)
 
 	sb, err := ioutil.ReadFile(tpl.output)
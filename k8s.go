@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+k8sPodInfoDir is where the downward API volume is expected to be mounted, with
+the files "name", "namespace", "labels" and "annotations". It has no standard
+location so it can be set with ENTRYPOINT_K8S_PODINFO_DIR.
+*/
+var k8sPodInfoDir = "/etc/podinfo"
+
+// k8sServiceAccountDir is where kubernetes mounts the service account
+var k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func podInfoDir() string {
+	if v := os.Getenv("ENTRYPOINT_K8S_PODINFO_DIR"); v != "" {
+		return v
+	}
+
+	return k8sPodInfoDir
+}
+
+func readTrimmed(path string) (string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(bs)), nil
+}
+
+// k8sPodName returns the pod name from the downward API, falling back to the hostname
+func k8sPodName() (string, error) {
+	if s, err := readTrimmed(filepath.Join(podInfoDir(), "name")); err == nil {
+		return s, nil
+	}
+
+	return hostname()
+}
+
+// k8sNamespace returns the namespace of the pod's service account or from the downward API
+func k8sNamespace() (string, error) {
+	if s, err := readTrimmed(filepath.Join(k8sServiceAccountDir, "namespace")); err == nil {
+		return s, nil
+	}
+
+	return readTrimmed(filepath.Join(podInfoDir(), "namespace"))
+}
+
+// k8sToken returns the pod's service account token
+func k8sToken() (string, error) {
+	return readTrimmed(filepath.Join(k8sServiceAccountDir, "token"))
+}
+
+func k8sLabels() (map[string]string, error) {
+	return readPodInfoMap("labels")
+}
+
+func k8sAnnotations() (map[string]string, error) {
+	return readPodInfoMap("annotations")
+}
+
+// downward API labels and annotations are written one per line as key="value"
+func readPodInfoMap(name string) (map[string]string, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(podInfoDir(), name))
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" {
+			continue
+		}
+
+		xs := strings.SplitN(l, "=", 2)
+		if len(xs) != 2 {
+			return nil, fmt.Errorf("%v: invalid line %q", name, l)
+		}
+
+		v, err := strconv.Unquote(xs[1])
+		if err != nil {
+			return nil, fmt.Errorf("%v: invalid value for %v: %v", name, xs[0], err)
+		}
+		m[xs[0]] = v
+	}
+
+	return m, scanner.Err()
+}
+
+// k8sOrdinal returns the ordinal of a StatefulSet pod, e.g. 2 for web-2
+func k8sOrdinal() (int, error) {
+	name, err := k8sPodName()
+	if err != nil {
+		return 0, err
+	}
+
+	i := strings.LastIndex(name, "-")
+	if i == -1 {
+		return 0, fmt.Errorf("%v is not a StatefulSet pod", name)
+	}
+
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("%v is not a StatefulSet pod", name)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withK8s points the k8s functions at temporary downward API and service account dirs
+func withK8s(t *testing.T, files map[string]string, f func()) {
+	dir, err := ioutil.TempDir("", "k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origPodInfo, origSA := k8sPodInfoDir, k8sServiceAccountDir
+	k8sPodInfoDir = filepath.Join(dir, "podinfo")
+	k8sServiceAccountDir = filepath.Join(dir, "serviceaccount")
+	defer func() { k8sPodInfoDir, k8sServiceAccountDir = origPodInfo, origSA }()
+
+	f()
+}
+
+func TestK8s(t *testing.T) {
+	files := map[string]string{
+		"podinfo/name":             "web-2\n",
+		"podinfo/labels":           "app=\"web\"\ntier=\"frontend\"\n",
+		"podinfo/annotations":      "note=\"a \\\"quoted\\\" value\"\n",
+		"serviceaccount/namespace": "prod",
+		"serviceaccount/token":     "token\n",
+	}
+
+	withK8s(t, files, func() {
+		tmpl := `{{ k8sPodName }} {{ k8sNamespace }} {{ k8sOrdinal }} {{ (k8sLabels).tier }} {{ (k8sAnnotations).note }} {{ k8sToken }}`
+		exepcted := `web-2 prod 2 frontend a "quoted" value token`
+		resp, err := newTpl("test", nil).renderStr(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != exepcted {
+			t.Errorf("%v is not equal to %v", resp, exepcted)
+		}
+	})
+
+}
+
+func TestK8sOrdinalInvalid(t *testing.T) {
+	withK8s(t, map[string]string{"podinfo/name": "web-abc"}, func() {
+		if _, err := k8sOrdinal(); err == nil {
+			t.Error("web-abc should not have an ordinal")
+		}
+	})
+
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+/*
+lintCmd implements "entrypoint lint", which parses templates with all of the
+template functions and checks references to the vars file. Files default to
+the sources of ENTRYPOINT_TEMPLATES. It returns non-zero if any problems were
+found.
+*/
+func lintCmd(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v lint [file...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		if v := os.Getenv("ENTRYPOINT_TEMPLATES"); v != "" {
+			files = strings.Split(v, ",")
+		}
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	problems := 0
+	vars, err := lintVars()
+	if err != nil {
+		fmt.Println(err)
+		problems++
+	}
+
+	var tpls []tpl
+	for _, spec := range files {
+		xs, err := expandTemplatePaths(spec)
+		if err != nil {
+			fmt.Println(err)
+			problems++
+			continue
+		}
+		tpls = append(tpls, xs...)
+	}
+	if err := checkOutputs(tpls); err != nil {
+		fmt.Println(err)
+		problems++
+	}
+
+	for _, t := range tpls {
+		for _, p := range lintTemplate(t.name, vars) {
+			fmt.Println(p)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+/*
+lintVars loads ENTRYPOINT_VARS_FILE, if any, for checking references to it.
+Only its keys are used, so secret functions in it are stubbed and lint works
+without AWS access.
+*/
+func lintVars() (map[string]interface{}, error) {
+	f := os.Getenv("ENTRYPOINT_VARS_FILE")
+	if f == "" {
+		return nil, nil
+	}
+
+	vars, err := loadVars(newTpl(f, nil).stubbed())
+	if err != nil {
+		return nil, fmt.Errorf("ENTRYPOINT_VARS_FILE: %v", err)
+	}
+	if env := os.Getenv("ENTRYPOINT_ENV"); env != "" {
+		if vars, err = selectEnv(vars, env); err != nil {
+			return nil, fmt.Errorf("ENTRYPOINT_ENV: %v", err)
+		}
+	}
+
+	// .Env depends on where the templates run so its keys aren't checked
+	return withEnv(vars, nil).(map[string]interface{}), nil
+}
+
+/*
+lintTemplate returns the problems found in a template as "file:line: message".
+Unknown functions and syntax errors are reported by the parser. If vars is not
+nil, fields of the root context such as .production.web.db are checked to
+exist in it.
+*/
+func lintTemplate(name string, vars map[string]interface{}) []string {
+	src, err := readSource(name)
+	if err != nil {
+		return []string{fmt.Sprintf("%v: %v", name, err)}
+	}
+	_, body, err := splitFrontMatter(name, string(src))
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	t := newTpl(name, nil)
+	parsed, err := template.New(name).Funcs(t.funcMap).Parse(body)
+	if err != nil {
+		return []string{strings.TrimPrefix(err.Error(), "template: ")}
+	}
+
+	if vars == nil {
+		return nil
+	}
+
+	l := &linter{tree: parsed.Tree, vars: vars}
+	l.walk(parsed.Tree.Root, true)
+
+	return l.problems
+}
+
+type linter struct {
+	tree     *parse.Tree
+	vars     map[string]interface{}
+	problems []string
+}
+
+// walk visits node. dotIsRoot is false inside range and with, where . changes.
+func (l *linter) walk(node parse.Node, dotIsRoot bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			l.walk(c, dotIsRoot)
+		}
+	case *parse.ActionNode:
+		l.walk(n.Pipe, dotIsRoot)
+	case *parse.IfNode:
+		l.walk(n.Pipe, dotIsRoot)
+		l.walk(n.List, dotIsRoot)
+		l.walk(n.ElseList, dotIsRoot)
+	case *parse.RangeNode:
+		l.walk(n.Pipe, dotIsRoot)
+		l.walk(n.List, false)
+		l.walk(n.ElseList, dotIsRoot)
+	case *parse.WithNode:
+		l.walk(n.Pipe, dotIsRoot)
+		l.walk(n.List, false)
+		l.walk(n.ElseList, dotIsRoot)
+	case *parse.TemplateNode:
+		l.walk(n.Pipe, dotIsRoot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			l.walk(c, dotIsRoot)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			l.walk(a, dotIsRoot)
+		}
+	case *parse.ChainNode:
+		l.walk(n.Node, dotIsRoot)
+	case *parse.FieldNode:
+		if dotIsRoot {
+			l.check(n, n.Ident)
+		}
+	case *parse.VariableNode:
+		// $ is always the root context
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			l.check(n, n.Ident[1:])
+		}
+	}
+}
+
+// check reports the first key of idents that is missing from the vars file
+func (l *linter) check(node parse.Node, idents []string) {
+	var cur interface{} = l.vars
+	for i, k := range idents {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			// not a map, e.g. a list or a method call, so can't be checked
+			return
+		}
+		if cur, ok = m[k]; !ok {
+			loc, _ := l.tree.ErrorContext(node)
+			l.problems = append(l.problems, fmt.Sprintf("%v: .%v is not defined in the vars file", lintLocation(loc), strings.Join(idents[:i+1], ".")))
+			return
+		}
+	}
+}
+
+// lintLocation turns "name:line:col" into "name:line"
+func lintLocation(loc string) string {
+	if i := strings.LastIndex(loc, ":"); i != -1 && strings.Count(loc, ":") > 1 {
+		return loc[:i]
+	}
+
+	return loc
+}
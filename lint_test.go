@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func lintTestFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestLintUnknownFunction(t *testing.T) {
+	name := lintTestFile(t, "ok\n{{ hostname }}\n{{ getSecret \"x\" }}\n")
+	defer os.Remove(name)
+
+	problems := lintTemplate(name, nil)
+	if len(problems) != 1 {
+		t.Fatalf("expected 1 problem, got %v", problems)
+	}
+	if !strings.HasPrefix(problems[0], name+":3:") || !strings.Contains(problems[0], "getSecret") {
+		t.Errorf("%v does not report getSecret on line 3", problems[0])
+	}
+
+}
+
+func TestLintVars(t *testing.T) {
+	vars, err := loadVars(newTpl("fixtures/vars-no-secret.yml", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := `{{ .production.web.db }}
+{{ .production.web.password }}
+{{ range .staging }}{{ .anything }}{{ end }}
+{{ with .staging.web }}{{ $.missing }}{{ end }}
+`
+	name := lintTestFile(t, tmpl)
+	defer os.Remove(name)
+
+	exepcted := []string{
+		name + ":2: .production.web.password is not defined in the vars file",
+		name + ":4: .missing is not defined in the vars file",
+	}
+	problems := lintTemplate(name, vars)
+	if strings.Join(problems, "\n") != strings.Join(exepcted, "\n") {
+		t.Errorf("%v is not equal to %v", problems, exepcted)
+	}
+
+}
+
+func TestLintVarsStubbed(t *testing.T) {
+	name := lintTestFile(t, `db:
+  password: {{ secret "db" }}
+  user: {{ (secretJSON "db").username }}
+  host: {{ ssm "/app/db_host" }}
+`)
+	defer os.Remove(name)
+	os.Setenv("ENTRYPOINT_VARS_FILE", name)
+	defer os.Unsetenv("ENTRYPOINT_VARS_FILE")
+
+	// no secrets are fetched, only the keys are needed
+	vars, err := lintVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := vars["db"].(map[string]interface{})
+	for _, k := range []string{"password", "user", "host"} {
+		if _, ok := db[k]; !ok {
+			t.Errorf("%v is missing from %v", k, vars)
+		}
+	}
+
+}
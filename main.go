@@ -1,23 +1,139 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // will be set va -ldflags
 var version = ""
 
+// envBool parses a boolean ENTRYPOINT_ variable, which defaults to false
+func envBool(k string) bool {
+	v := os.Getenv(k)
+	if v == "" {
+		return false
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Error: %v: %v", k, err)
+	}
+
+	return b
+}
+
+// shellQuote single quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+/*
+writeEnvFile writes vars to path as shell variable assignments, with values
+single quoted so that the file can be sourced.
+*/
+func writeEnvFile(path string, vars map[string]string) error {
+	var keys []string
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%v=%v\n", k, shellQuote(vars[k]))
+	}
+
+	return ioutil.WriteFile(path, b.Bytes(), 0600)
+}
+
+/*
+rawEnvVars returns the names in ENTRYPOINT_RAW_ENV, whose values are passed
+through as is even if they look like templates.
+*/
+func rawEnvVars() map[string]bool {
+	raw := make(map[string]bool)
+	for _, k := range strings.Split(os.Getenv("ENTRYPOINT_RAW_ENV"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			raw[k] = true
+		}
+	}
+
+	return raw
+}
+
+// isTemplate reports whether an env var value contains template actions
+func isTemplate(v string) bool {
+	return strings.Contains(v, "{{")
+}
+
+/*
+loadContext loads ENTRYPOINT_VARS_FILE, if any, as the context for templates
+and reports whether it used a secret function. Secrets in it are masked if
+mask is true.
+*/
+func loadContext(mask bool) (interface{}, bool) {
+	f := os.Getenv("ENTRYPOINT_VARS_FILE")
+	if f == "" {
+		return nil, false
+	}
+
+	t := newTpl(f, nil)
+	if mask {
+		t = t.masked()
+	}
+	vars, err := loadVars(t)
+	if err != nil {
+		log.Fatalf("Error: ENTRYPOINT_VARS_FILE: %v", err)
+	}
+	if env := os.Getenv("ENTRYPOINT_ENV"); env != "" {
+		if vars, err = selectEnv(vars, env); err != nil {
+			log.Fatalf("Error: ENTRYPOINT_ENV: %v", err)
+		}
+	}
+
+	return vars, *t.sensitive
+}
+
+// exitOnErrors logs errs and exits if there are any
+func exitOnErrors(errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+
+	log.Printf("Error: %v template(s) failed to render:", len(errs))
+	for _, err := range errs {
+		log.Printf("  %v", err)
+	}
+	os.Exit(1)
+}
+
 func main() {
-	usage := fmt.Sprintf("Usage: %v cmd [argN...]", os.Args[0])
+	usage := fmt.Sprintf("Usage: %v cmd [argN...] | render [-mask] [-e expression | file...] | lint [file...]", os.Args[0])
 
-	if len(os.Args) < 2 {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			os.Exit(renderCmd(os.Args[2:]))
+		case "lint":
+			os.Exit(lintCmd(os.Args[2:]))
+		}
+	}
+
+	// only render templates, e.g. in an init container
+	renderOnly := envBool("ENTRYPOINT_RENDER_ONLY")
+
+	if len(os.Args) < 2 && !renderOnly {
 		log.Fatal(usage)
 	}
 
@@ -25,48 +141,78 @@ func main() {
 	log.Println("entrypoint version:", version)
 	log.Println("entrypoint arguments:", strings.Join(execArgs, " "))
 
-	cmdPath, err := exec.LookPath(execArgs[0])
-	if err != nil {
-		log.Fatal(err)
+	var cmdPath string
+	var err error
+	if !renderOnly {
+		if cmdPath, err = exec.LookPath(execArgs[0]); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	containerVars := make(map[string]string)
 	var templates []string
 
-	// parse ENV vars
-	for _, i := range os.Environ() {
-		xs := strings.Split(i, "=")
-		k := xs[0]
-		v := xs[1]
-
-		if strings.HasPrefix(k, "ENTRYPOINT_") {
-			if !checkEntrypointVar(k) {
-				log.Fatalf("Error: %v is not one of %v", k, entrypointEnvVars)
-			}
-		} else {
-			containerVars[k] = v
-		}
+	// context passed to all templates
+	ctx, sensitive := loadContext(false)
+
+	// errors are collected so that all failures are reported at once
+	var mu sync.Mutex
 
-		// render any secrets in env vars
-		if matched, _ := regexp.Match(`^{{.*}}$`, []byte(v)); matched {
-			rv := newTpl(k).renderStr(v)
-			// override env var with secret value
-			os.Setenv(k, rv)
-			containerVars[k] = rv
+	// parse ENV vars
+	environ := parseEnv(os.Environ())
+	for _, k := range environ.keys {
+		if strings.HasPrefix(k, "ENTRYPOINT_") && !checkEntrypointVar(k) {
+			log.Fatalf("Error: %v is not one of %v", k, entrypointEnvVars)
 		}
 
 		if k == "ENTRYPOINT_TEMPLATES" {
+			v, _ := environ.get(k)
 			templates = strings.Split(v, ",")
 		}
 	}
 
-	if len(templates) > 0 {
+	// render any secrets in env vars, dependencies first so env sees rendered values
+	renderedVars, sensitiveEnv, errs := environ.render(ctx, rawEnvVars(), false)
+	// file templates may depend on env vars, so don't render any with a failed env var
+	exitOnErrors(errs)
+
+	containerEnv := newEnv()
+	for _, k := range environ.keys {
+		if !strings.HasPrefix(k, "ENTRYPOINT_") {
+			v, _ := environ.get(k)
+			containerEnv.set(k, v)
+		}
+	}
+
+	ctx = withEnv(ctx, containerEnv.toMap())
+
+	var tpls []tpl
+	for _, spec := range templates {
+		xs, err := expandTemplateSpec(spec, ctx)
+		if err != nil {
+			log.Fatalf("Error: ENTRYPOINT_TEMPLATES: %v", err)
+		}
+		tpls = append(tpls, xs...)
+	}
+	if err := checkOutputs(tpls); err != nil {
+		log.Fatalf("Error: ENTRYPOINT_TEMPLATES: %v", err)
+	}
+
+	// secrets in the context make every output sensitive
+	for i := range tpls {
+		tpls[i].sensitiveCtx = sensitive || sensitiveEnv
+	}
+
+	if len(tpls) > 0 {
 		wg := sync.WaitGroup{}
 
-		for _, t := range templates {
+		for _, t := range tpls {
 			wg.Add(1)
-			go func(t string) {
-				newTpl(t).renderFile()
+			go func(t tpl) {
+				if err := t.renderFile(); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
 				wg.Done()
 			}(t)
 		}
@@ -75,9 +221,40 @@ func main() {
 
 	}
 
-	var containerVarsXs []string
-	for k, v := range containerVars {
-		containerVarsXs = append(containerVarsXs, k+"="+v)
+	exitOnErrors(errs)
+
+	if renderOnly {
+		if f := os.Getenv("ENTRYPOINT_ENV_FILE"); f != "" {
+			if err := writeEnvFile(f, renderedVars); err != nil {
+				log.Fatalf("Error: ENTRYPOINT_ENV_FILE: %v", err)
+			}
+		}
+		log.Println("entrypoint: rendered templates")
+		os.Exit(0)
+	}
+
+	containerVarsXs := containerEnv.environ()
+
+	supervise := envBool("ENTRYPOINT_SUPERVISE")
+
+	var interval time.Duration
+	if v := os.Getenv("ENTRYPOINT_RENDER_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Error: ENTRYPOINT_RENDER_INTERVAL: %v", err)
+		}
+		if !supervise {
+			log.Fatal("Error: ENTRYPOINT_RENDER_INTERVAL requires ENTRYPOINT_SUPERVISE")
+		}
+	}
+
+	if supervise {
+		s := newSupervisor(cmdPath, execArgs, containerVarsXs)
+		if interval > 0 {
+			if err := s.watch(tpls, interval, os.Getenv("ENTRYPOINT_RELOAD_SIGNAL")); err != nil {
+				log.Fatalf("Error: ENTRYPOINT_RELOAD_SIGNAL: %v", err)
+			}
+		}
+		os.Exit(s.run())
 	}
 
 	err = syscall.Exec(cmdPath, execArgs, containerVarsXs)
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+)
+
+// secretMask replaces secrets with -mask. It can't start with * as that's an
+// alias in an unquoted value of the vars file.
+const secretMask string = "MASKED"
+
+/*
+renderCmd implements "entrypoint render", which renders template files or an
+inline expression to stdout for debugging, using the same functions and vars
+file as the entrypoint itself.
+*/
+func renderCmd(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	expr := fs.String("e", "", "render `expression` instead of files")
+	mask := fs.Bool("mask", false, "mask the values of secrets")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v render [-mask] [-e expression | file...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if (*expr == "") == (fs.NArg() == 0) {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, _ := loadContext(*mask)
+
+	environ := parseEnv(os.Environ())
+	if _, _, errs := environ.render(ctx, rawEnvVars(), *mask); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Error: %v", err)
+		}
+		return 1
+	}
+	ctx = withEnv(ctx, environ.toMap())
+
+	if *expr != "" {
+		t := newTpl("expression", ctx)
+		if *mask {
+			t = t.masked()
+		}
+		s, err := t.renderStr(*expr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return 1
+		}
+		fmt.Println(s)
+		return 0
+	}
+
+	rc := 0
+	for _, name := range fs.Args() {
+		t := newTpl(name, ctx)
+		if *mask {
+			t = t.masked()
+		}
+		bs, err := t.render()
+		if err != nil {
+			log.Printf("Error: %v", err)
+			rc = 1
+			continue
+		}
+		os.Stdout.Write(bs)
+	}
+
+	return rc
+}
+
+/*
+masked returns a copy of tpl whose secret functions still fetch the secret,
+so that errors are reported, but render a mask instead of the value.
+*/
+func (tpl tpl) masked() tpl {
+	return tpl.wrapSecrets(maskFunc)
+}
+
+/*
+stubbed returns a copy of tpl whose secret functions render the mask without
+fetching anything, for when only the shape of the output matters. Missing
+keys, e.g. of a stubbed secretJSON, render as empty.
+*/
+func (tpl tpl) stubbed() tpl {
+	tpl = tpl.wrapSecrets(stubFunc)
+	tpl.opts = []string{"missingkey=zero"}
+	return tpl
+}
+
+// wrapSecrets returns a copy of tpl with each secret function replaced by wrap(fn)
+func (tpl tpl) wrapSecrets(wrap func(interface{}) interface{}) tpl {
+	funcMap := make(map[string]interface{}, len(tpl.funcMap))
+	for k, v := range tpl.funcMap {
+		funcMap[k] = v
+	}
+
+	for _, k := range secretFuncs {
+		funcMap[k] = wrap(funcMap[k])
+	}
+
+	tpl.funcMap = funcMap
+	return tpl
+}
+
+// maskFunc wraps a secret function so that it returns the mask in place of its value
+func maskFunc(fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		var out []reflect.Value
+		if v.Type().IsVariadic() {
+			out = v.CallSlice(args)
+		} else {
+			out = v.Call(args)
+		}
+		if err := out[len(out)-1]; !err.IsNil() {
+			return out
+		}
+		out[0] = maskValue(out[0])
+		return out
+	}).Interface()
+}
+
+// stubFunc returns a function with the signature of the secret function fn that only returns the mask
+func stubFunc(fn interface{}) interface{} {
+	t := reflect.TypeOf(fn)
+	return reflect.MakeFunc(t, func([]reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		out[0] = maskValue(out[0])
+		return out
+	}).Interface()
+}
+
+// maskValue replaces a string with the mask, or the values of a map
+func maskValue(v reflect.Value) reflect.Value {
+	mask := reflect.ValueOf(secretMask)
+
+	switch v.Kind() {
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			m.SetMapIndex(k, mask.Convert(v.Type().Elem()))
+		}
+		return m
+	default:
+		return mask.Convert(v.Type())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenderMasked(t *testing.T) {
+	withK8s(t, map[string]string{"serviceaccount/token": "token"}, func() {
+		tmpl := `{{ k8sToken }}`
+		resp, err := newTpl("test", nil).masked().renderStr(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != secretMask {
+			t.Errorf("%v is not equal to %v", resp, secretMask)
+		}
+	})
+
+}
+
+func TestMaskFunc(t *testing.T) {
+	str := maskFunc(func(name string, version ...string) (string, error) {
+		return "password", nil
+	}).(func(string, ...string) (string, error))
+	if s, _ := str("db", "AWSPREVIOUS"); s != secretMask {
+		t.Errorf("%v is not equal to %v", s, secretMask)
+	}
+
+	m := maskFunc(func(prefix string) (map[string]string, error) {
+		return map[string]string{"user": "app", "password": "password"}, nil
+	}).(func(string) (map[string]string, error))
+	exepcted := map[string]string{"user": secretMask, "password": secretMask}
+	if resp, _ := m("/app/"); !reflect.DeepEqual(resp, exepcted) {
+		t.Errorf("%v is not equal to %v", resp, exepcted)
+	}
+
+	i := maskFunc(func(name, key string) (interface{}, error) {
+		return 5432, nil
+	}).(func(string, string) (interface{}, error))
+	if resp, _ := i("db", "port"); resp != secretMask {
+		t.Errorf("%v is not equal to %v", resp, secretMask)
+	}
+
+	failing := maskFunc(func(name string) (string, error) {
+		return "", errors.New("no such secret")
+	}).(func(string) (string, error))
+	if _, err := failing("db"); err == nil {
+		t.Errorf("errors should be returned")
+	}
+
+}
+
+func TestLoadVarsMasked(t *testing.T) {
+	withK8s(t, map[string]string{"serviceaccount/token": "token"}, func() {
+		dir, err := ioutil.TempDir("", "vars")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "vars.yml")
+		if err := ioutil.WriteFile(path, []byte("token: {{ k8sToken }}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		vars, err := loadVars(newTpl(path, nil).masked())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vars["token"] != secretMask {
+			t.Errorf("%v is not equal to %v", vars["token"], secretMask)
+		}
+	})
+
+}
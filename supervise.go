@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadRestart is the ENTRYPOINT_RELOAD_SIGNAL value that restarts the child
+// instead of signalling it.
+const reloadRestart string = "restart"
+
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+/*
+children lets processes started while the supervisor is running get their
+wait status. reap waits on any child, so it would otherwise collect them
+before exec.Cmd.Wait could.
+*/
+var children = &childWaiter{waiting: make(map[int]chan syscall.WaitStatus)}
+
+type childWaiter struct {
+	mu      sync.Mutex
+	reaping bool
+	waiting map[int]chan syscall.WaitStatus
+}
+
+/*
+combinedOutput runs name with args and returns its combined stdout and stderr
+like exec.Cmd.CombinedOutput, but gets its wait status from reap while the
+supervisor is running.
+*/
+func (c *childWaiter) combinedOutput(name string, args ...string) ([]byte, error) {
+	c.mu.Lock()
+	if !c.reaping {
+		c.mu.Unlock()
+		return exec.Command(name, args...).CombinedOutput()
+	}
+
+	// the lock is held until the pid is registered so that reap can't miss it
+	ch, r, err := c.start(name, args...)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ioutil.ReadAll(r)
+	r.Close()
+	ws := <-ch
+	if err != nil {
+		return out, err
+	}
+
+	switch {
+	case ws.Signaled():
+		return out, fmt.Errorf("signal: %v", ws.Signal())
+	case ws.ExitStatus() != 0:
+		return out, fmt.Errorf("exit status %v", ws.ExitStatus())
+	}
+
+	return out, nil
+}
+
+// start starts name with a pipe for its output and registers it to be waited for by reap
+func (c *childWaiter) start(name string, args ...string) (chan syscall.WaitStatus, *os.File, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer null.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.Close()
+
+	proc, err := os.StartProcess(path, append([]string{name}, args...), &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{null, w, w},
+	})
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+
+	ch := make(chan syscall.WaitStatus, 1)
+	c.waiting[proc.Pid] = ch
+
+	return ch, r, nil
+}
+
+func (c *childWaiter) setReaping(reaping bool) {
+	c.mu.Lock()
+	c.reaping = reaping
+	c.mu.Unlock()
+}
+
+/*
+supervisor runs the command as a child process instead of replacing
+entrypoint with it. This lets entrypoint act as PID 1: signals are
+forwarded to the child and orphaned processes are reaped.
+*/
+type supervisor struct {
+	path string
+	args []string
+	env  []string
+	proc *os.Process
+
+	// templates are re-rendered every interval when it is non-zero. If any
+	// output changed the child is sent reloadSig, or restarted if it is nil.
+	templates  []tpl
+	interval   time.Duration
+	reloadSig  os.Signal
+	restarting bool
+	// stopping is set once the child was sent a terminating signal
+	stopping bool
+}
+
+func newSupervisor(path string, args []string, env []string) *supervisor {
+	return &supervisor{
+		path: path,
+		args: args,
+		env:  env,
+	}
+}
+
+/*
+parseReloadSignal parses a signal name such as "HUP" or "SIGUSR1". It returns
+nil for "restart", to restart the child instead, and SIGHUP if sig is empty.
+*/
+func parseReloadSignal(sig string) (os.Signal, error) {
+	switch sig {
+	case reloadRestart:
+		return nil, nil
+	case "":
+		return syscall.SIGHUP, nil
+	}
+
+	rs, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(sig), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported reload signal %v", sig)
+	}
+
+	return rs, nil
+}
+
+// watch enables periodic re-rendering of templates, see parseReloadSignal for sig.
+func (s *supervisor) watch(templates []tpl, interval time.Duration, sig string) error {
+	rs, err := parseReloadSignal(sig)
+	if err != nil {
+		return err
+	}
+
+	s.templates = templates
+	s.interval = interval
+	s.reloadSig = rs
+
+	return nil
+}
+
+func (s *supervisor) start() {
+	proc, err := os.StartProcess(s.path, s.args, &os.ProcAttr{
+		Env:   s.env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		log.Fatalf("supervisor: %v", err)
+	}
+
+	log.Println("supervisor: started pid", proc.Pid)
+	s.proc = proc
+}
+
+// run starts the child and blocks until it exits, returning the exit status
+// that entrypoint should exit with.
+func (s *supervisor) run() int {
+	sigs := make(chan os.Signal, 32)
+	// no arguments means all incoming signals
+	signal.Notify(sigs)
+	defer signal.Stop(sigs)
+
+	children.setReaping(true)
+	defer children.setReaping(false)
+
+	s.start()
+
+	var tick <-chan time.Time
+	if s.interval > 0 && len(s.templates) > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// rendering may block on AWS calls so it runs outside of the signal loop
+	changed := make(chan bool, 1)
+	rendering := false
+
+	for {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGCHLD:
+				status, exited := s.reap()
+				if !exited {
+					continue
+				}
+				if !s.restarting {
+					return status
+				}
+				s.restarting = false
+				s.start()
+			case syscall.SIGURG:
+				// used internally by the go runtime for goroutine preemption
+			default:
+				// the child is going to exit for good, not to be restarted
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT || sig == syscall.SIGQUIT {
+					s.stopping = true
+					s.restarting = false
+				}
+				if err := s.proc.Signal(sig); err != nil {
+					log.Printf("supervisor: could not forward %v: %v", sig, err)
+				}
+			}
+		case <-tick:
+			if rendering {
+				continue
+			}
+			rendering = true
+			go func() {
+				changed <- s.rerender()
+			}()
+		case c := <-changed:
+			rendering = false
+			if c {
+				s.reload()
+			}
+		}
+	}
+}
+
+// rerender re-renders all templates and reports whether any output changed.
+func (s *supervisor) rerender() bool {
+	changed := false
+	for _, t := range s.templates {
+		c, err := t.rerender()
+		if err != nil {
+			// keep the previous output and try again next interval
+			log.Printf("supervisor: %v", err)
+			continue
+		}
+		if c {
+			log.Println("supervisor: re-rendered", t.name)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (s *supervisor) reload() {
+	if s.stopping || s.restarting {
+		return
+	}
+
+	if s.reloadSig == nil {
+		log.Println("supervisor: restarting pid", s.proc.Pid)
+		s.restarting = true
+		if err := s.proc.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("supervisor: could not restart: %v", err)
+		}
+		return
+	}
+
+	log.Printf("supervisor: sending %v to pid %v", s.reloadSig, s.proc.Pid)
+	if err := s.proc.Signal(s.reloadSig); err != nil {
+		log.Printf("supervisor: could not send %v: %v", s.reloadSig, err)
+	}
+}
+
+/*
+reap waits on all children that have exited, including orphans that were
+re-parented to us. Processes started with children.combinedOutput are handed
+their wait status. It reports whether our own child was among them along
+with its exit status, or 128+signal if it was killed by a signal.
+*/
+func (s *supervisor) reap() (int, bool) {
+	status := 0
+	exited := false
+
+	children.mu.Lock()
+	defer children.mu.Unlock()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			break
+		}
+
+		if ch, ok := children.waiting[pid]; ok {
+			delete(children.waiting, pid)
+			ch <- ws
+			continue
+		}
+		if pid != s.proc.Pid {
+			continue
+		}
+
+		exited = true
+		switch {
+		case ws.Exited():
+			status = ws.ExitStatus()
+		case ws.Signaled():
+			status = 128 + int(ws.Signal())
+		}
+		log.Printf("supervisor: pid %v exited with status %v", pid, status)
+	}
+
+	return status, exited
+}
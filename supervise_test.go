@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForFile polls for path, which a child creates once it is ready
+func waitForFile(t *testing.T, path string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%v was not created", path)
+}
+
+func TestSuperviseExitStatus(t *testing.T) {
+	tests := map[string]int{
+		"exit 0":        0,
+		"exit 3":        3,
+		"kill -TERM $$": 143,
+		"kill -KILL $$": 137,
+	}
+
+	for script, exepcted := range tests {
+		s := newSupervisor("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+		if status := s.run(); status != exepcted {
+			t.Errorf("%v: %v is not equal to %v", script, status, exepcted)
+		}
+	}
+
+}
+
+func TestSuperviseForwardSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := filepath.Join(dir, "ready")
+	script := "trap 'exit 7' USR1; touch " + ready + "; while :; do sleep 0.05; done"
+	s := newSupervisor("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+
+	status := make(chan int)
+	go func() {
+		status <- s.run()
+	}()
+
+	waitForFile(t, ready)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	select {
+	case st := <-status:
+		if st != 7 {
+			t.Errorf("%v is not equal to %v", st, 7)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGUSR1 was not forwarded to the child")
+	}
+
+}
+
+func TestParseReloadSignal(t *testing.T) {
+	tests := map[string]os.Signal{
+		"":        syscall.SIGHUP,
+		"HUP":     syscall.SIGHUP,
+		"SIGUSR1": syscall.SIGUSR1,
+		"usr2":    syscall.SIGUSR2,
+		"restart": nil,
+	}
+
+	for name, exepcted := range tests {
+		sig, err := parseReloadSignal(name)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		if sig != exepcted {
+			t.Errorf("%v: %v is not equal to %v", name, sig, exepcted)
+		}
+	}
+
+	if _, err := parseReloadSignal("KILL"); err == nil {
+		t.Errorf("KILL should not be a valid reload signal")
+	}
+
+}
+
+// watchedTemplate writes a template to dir and returns it along with its output
+func watchedTemplate(t *testing.T, dir, body string) tpl {
+	src := filepath.Join(dir, "app.conf.tmpl")
+	if err := ioutil.WriteFile(src, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tpl := newTpl(src, nil)
+	if err := tpl.renderFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tpl
+}
+
+func TestSuperviseReload(t *testing.T) {
+	tests := []struct {
+		body     string
+		exepcted int
+	}{
+		// unchanged output doesn't reload the child
+		{"static", 0},
+		{"{{ now.UnixNano }}", 9},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "supervise")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := newSupervisor("/bin/sh", []string{"sh", "-c", "trap 'exit 9' HUP; sleep 0.5"}, os.Environ())
+		if err := s.watch([]tpl{watchedTemplate(t, dir, test.body)}, 20*time.Millisecond, "HUP"); err != nil {
+			t.Fatal(err)
+		}
+
+		if status := s.run(); status != test.exepcted {
+			t.Errorf("%v: %v is not equal to %v", test.body, status, test.exepcted)
+		}
+	}
+
+}
+
+func TestSuperviseTermWhileRestarting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the child takes a while to exit when restarted
+	stopping := filepath.Join(dir, "stopping")
+	script := "trap 'touch " + stopping + "; sleep 0.3; exit 0' TERM; while :; do sleep 0.05; done"
+	s := newSupervisor("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+	if err := s.watch([]tpl{watchedTemplate(t, dir, "{{ now.UnixNano }}")}, 20*time.Millisecond, reloadRestart); err != nil {
+		t.Fatal(err)
+	}
+
+	status := make(chan int)
+	go func() {
+		status <- s.run()
+	}()
+
+	waitForFile(t, stopping)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case st := <-status:
+		if st != 0 {
+			t.Errorf("%v is not equal to %v", st, 0)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the child was restarted after SIGTERM")
+	}
+
+}
+
+func TestSuperviseValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := filepath.Join(dir, "ready")
+	stop := filepath.Join(dir, "stop")
+	// keep reap busy so that it races the validators for their wait status
+	script := "touch " + ready + "; while [ ! -f " + stop + " ]; do kill -CHLD $PPID; done"
+	s := newSupervisor("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+	vt := watchedTemplate(t, dir, "---\nvalidate: true {{output}}\n---\n{{ now.UnixNano }}")
+	if err := s.watch([]tpl{vt}, time.Hour, "HUP"); err != nil {
+		t.Fatal(err)
+	}
+
+	status := make(chan int)
+	go func() {
+		status <- s.run()
+	}()
+	waitForFile(t, ready)
+	defer ioutil.WriteFile(stop, nil, 0644)
+
+	// validators exit while reap is collecting children
+	for i := 0; i < 30; i++ {
+		if !s.rerender() {
+			t.Fatalf("re-render %v failed", i)
+		}
+	}
+
+	ioutil.WriteFile(stop, nil, 0644)
+	if st := <-status; st != 0 {
+		t.Errorf("%v is not equal to %v", st, 0)
+	}
+
+}
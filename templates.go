@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+templateSpec is a parsed ENTRYPOINT_TEMPLATES entry of the form
+src[:dest[:mode[:uid[:gid]]]]. Empty fields are left as their defaults, e.g.
+"app.conf.tmpl::0640" only sets the mode.
+*/
+type templateSpec struct {
+	src  string
+	dest string
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// trimExt strips a trailing template extension from name
+func trimExt(name string) string {
+	for _, ext := range []string{tmplExt, tplExt} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+
+	return name
+}
+
+// parseTemplateSpec parses an ENTRYPOINT_TEMPLATES entry. src may be an s3:// url.
+func parseTemplateSpec(spec string) (templateSpec, error) {
+	return parseSpec(spec, true)
+}
+
+// parseSpec implements parseTemplateSpec, leaving uid and gid unset unless lookupIDs is true
+func parseSpec(spec string, lookupIDs bool) (templateSpec, error) {
+	ts := templateSpec{uid: -1, gid: -1}
+
+	offset := 0
+	if strings.HasPrefix(spec, s3Prefix) {
+		offset = len(s3Prefix)
+	}
+
+	i := strings.Index(spec[offset:], ":")
+	if i == -1 {
+		ts.src = spec
+		return ts, nil
+	}
+	ts.src = spec[:offset+i]
+
+	xs := strings.Split(spec[offset+i+1:], ":")
+	if len(xs) > 4 {
+		return ts, fmt.Errorf("%v: expected src[:dest[:mode[:uid[:gid]]]]", spec)
+	}
+	xs = append(xs, make([]string, 4-len(xs))...)
+
+	ts.dest = xs[0]
+
+	if xs[1] != "" {
+		m, err := strconv.ParseUint(xs[1], 8, 32)
+		if err != nil {
+			return ts, fmt.Errorf("%v: invalid mode %v", spec, xs[1])
+		}
+		ts.mode = os.FileMode(m)
+	}
+
+	if !lookupIDs {
+		return ts, nil
+	}
+
+	var err error
+	if xs[2] != "" {
+		if ts.uid, err = lookupID(xs[2], false); err != nil {
+			return ts, fmt.Errorf("%v: %v", spec, err)
+		}
+	}
+	if xs[3] != "" {
+		if ts.gid, err = lookupID(xs[3], true); err != nil {
+			return ts, fmt.Errorf("%v: %v", spec, err)
+		}
+	}
+
+	return ts, nil
+}
+
+// lookupID resolves a numeric id or a user or group name
+func lookupID(s string, group bool) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+
+	var id string
+	if group {
+		g, err := user.LookupGroup(s)
+		if err != nil {
+			return -1, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(s)
+		if err != nil {
+			return -1, err
+		}
+		id = u.Uid
+	}
+
+	return strconv.Atoi(id)
+}
+
+/*
+expandTemplateSpec returns the templates for an ENTRYPOINT_TEMPLATES entry.
+A src that is a directory is searched recursively for templates, which are
+rendered into the same relative paths under dest if given. A src that is a
+glob pattern renders each match, under dest if given at its path relative to
+the directory the pattern starts in.
+*/
+func expandTemplateSpec(spec string, ctx interface{}) ([]tpl, error) {
+	ts, err := parseTemplateSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.expand(ctx)
+}
+
+/*
+expandTemplatePaths is like expandTemplateSpec but doesn't look up the uid and
+gid, which may not exist where the spec is checked rather than rendered.
+*/
+func expandTemplatePaths(spec string) ([]tpl, error) {
+	ts, err := parseSpec(spec, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.expand(nil)
+}
+
+func (ts templateSpec) newTpl(src string, dest string, ctx interface{}) tpl {
+	t := newTpl(src, ctx).withOutput(dest)
+	t.mode = ts.mode
+	t.uid = ts.uid
+	t.gid = ts.gid
+
+	return t
+}
+
+func (ts templateSpec) expand(ctx interface{}) ([]tpl, error) {
+	if strings.HasPrefix(ts.src, s3Prefix) {
+		return []tpl{ts.newTpl(ts.src, ts.dest, ctx)}, nil
+	}
+
+	if strings.ContainsAny(ts.src, "*?[") {
+		matches, err := filepath.Glob(ts.src)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", ts.src, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%v: no templates match", ts.src)
+		}
+
+		base := globBase(ts.src)
+		var tpls []tpl
+		for _, m := range matches {
+			match := ts
+			match.src = m
+			if ts.dest != "" {
+				rel, err := filepath.Rel(base, m)
+				if err != nil {
+					return nil, err
+				}
+				match.dest = filepath.Join(ts.dest, trimExt(rel))
+			}
+			xs, err := match.expand(ctx)
+			if err != nil {
+				return nil, err
+			}
+			tpls = append(tpls, xs...)
+		}
+		return tpls, nil
+	}
+
+	fi, err := os.Stat(ts.src)
+	if err != nil || !fi.IsDir() {
+		return []tpl{ts.newTpl(ts.src, ts.dest, ctx)}, nil
+	}
+
+	var tpls []tpl
+	err = filepath.Walk(ts.src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || trimExt(p) == p {
+			return nil
+		}
+
+		dest := ""
+		if ts.dest != "" {
+			rel, err := filepath.Rel(ts.src, p)
+			if err != nil {
+				return err
+			}
+			dest = filepath.Join(ts.dest, trimExt(rel))
+		}
+		tpls = append(tpls, ts.newTpl(p, dest, ctx))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tpls, nil
+}
+
+// globBase returns the directory of pattern up to its first glob character
+func globBase(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+
+	return dir
+}
+
+// checkOutputs returns an error if more than one template renders to the same file
+func checkOutputs(tpls []tpl) error {
+	names := make(map[string]string)
+	for _, t := range tpls {
+		if name, ok := names[t.output]; ok {
+			return fmt.Errorf("%v and %v both render to %v", name, t.name, t.output)
+		}
+		names[t.output] = t.name
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// validateOutput is replaced with the path of the rendered file in validate commands
+const validateOutput string = "{{output}}"
+
+// formatNone turns off checking of the output format
+const formatNone string = "none"
+
+// formatExts maps output file extensions to the format they're checked as
+var formatExts = map[string]string{
+	".json": "json",
+	".yml":  "yaml",
+	".yaml": "yaml",
+	".toml": "toml",
+}
+
+// yaml and toml parse errors include "line N"
+var errLineRe = regexp.MustCompile(`line (\d+)`)
+
+/*
+runValidate runs the template's validate command, e.g. "nginx -t -c
+{{output}}", with sh against path, the rendered but not yet installed file,
+which is substituted quoted. The validator's output is included in the error
+if it fails.
+*/
+func (tpl tpl) runValidate(path string) error {
+	if tpl.validate == "" {
+		return nil
+	}
+
+	cmd := strings.Replace(tpl.validate, validateOutput, shellQuote(path), -1)
+	out, err := children.combinedOutput("/bin/sh", "-c", cmd)
+	if err != nil {
+		return fmt.Errorf("%v: validation failed: %v: %v\n%s", tpl.name, cmd, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// outputFormat returns the format set for tpl or the one implied by its output's extension
+func (tpl tpl) outputFormat() string {
+	if tpl.format != "" {
+		return tpl.format
+	}
+
+	return formatExts[strings.ToLower(filepath.Ext(tpl.output))]
+}
+
+/*
+checkFormat parses rendered output as JSON, YAML or TOML, depending on
+outputFormat, and checks it against the template's JSON schema if it has one.
+Syntax errors point at the offending line of the output.
+*/
+func (tpl tpl) checkFormat(bs []byte) error {
+	var docs []interface{}
+	var err error
+
+	switch f := tpl.outputFormat(); f {
+	case "", formatNone:
+		return nil
+	case "json":
+		docs, err = decodeJSON(bs)
+	case "yaml":
+		docs, err = decodeYAML(bs)
+	case "toml":
+		docs, err = decodeTOML(bs)
+	default:
+		return fmt.Errorf("%v: unknown format %v", tpl.name, f)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: rendered output is not valid %v: %v", tpl.name, tpl.outputFormat(), err)
+	}
+
+	if tpl.schema == "" {
+		return nil
+	}
+
+	src, err := readSource(tpl.schema)
+	if err != nil {
+		return fmt.Errorf("%v: %v", tpl.name, err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(src))
+	if err != nil {
+		return fmt.Errorf("%v: invalid schema %v: %v", tpl.name, tpl.schema, err)
+	}
+
+	for _, doc := range docs {
+		r, err := schema.Validate(gojsonschema.NewGoLoader(doc))
+		if err != nil {
+			return fmt.Errorf("%v: %v", tpl.name, err)
+		}
+		if !r.Valid() {
+			var problems []string
+			for _, e := range r.Errors() {
+				problems = append(problems, "\t"+e.String())
+			}
+			return fmt.Errorf("%v: rendered output does not match schema %v:\n%v", tpl.name, tpl.schema, strings.Join(problems, "\n"))
+		}
+	}
+
+	return nil
+}
+
+func decodeJSON(bs []byte) ([]interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal(bs, &v)
+	switch e := err.(type) {
+	case nil:
+		return []interface{}{v}, nil
+	case *json.SyntaxError:
+		return nil, lineError(bs, lineAt(bs, e.Offset), err)
+	case *json.UnmarshalTypeError:
+		return nil, lineError(bs, lineAt(bs, e.Offset), err)
+	default:
+		return nil, err
+	}
+}
+
+// decodeYAML decodes every document in bs
+func decodeYAML(bs []byte) ([]interface{}, error) {
+	var docs []interface{}
+	d := yaml.NewDecoder(bytes.NewReader(bs))
+	for {
+		var v interface{}
+		if err := d.Decode(&v); err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, lineError(bs, errLine(err), err)
+		}
+		docs = append(docs, normalizeValue(v))
+	}
+}
+
+func decodeTOML(bs []byte) ([]interface{}, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(bs), &v); err != nil {
+		return nil, lineError(bs, errLine(err), err)
+	}
+
+	return []interface{}{v}, nil
+}
+
+// lineAt returns the 1-based line of offset in bs
+func lineAt(bs []byte, offset int64) int {
+	if offset > int64(len(bs)) {
+		offset = int64(len(bs))
+	}
+
+	return bytes.Count(bs[:offset], []byte("\n")) + 1
+}
+
+func errLine(err error) int {
+	m := errLineRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+
+	return n
+}
+
+// lineError adds the text of line n of bs to err
+func lineError(bs []byte, n int, err error) error {
+	lines := strings.Split(string(bs), "\n")
+	if n < 1 || n > len(lines) {
+		return err
+	}
+
+	return fmt.Errorf("%v\n\t%d: %s", err, n, lines[n-1])
+}
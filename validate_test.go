@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderFileValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "test.conf.tmpl")
+	validate := "---\nvalidate: grep -q '^good' {{output}} || { echo bad config; exit 1; }\n---\n"
+	for _, tmpl := range []string{"good", "broken"} {
+		if err := ioutil.WriteFile(src, []byte(validate+tmpl), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err = newTpl(src, nil).renderFile()
+	}
+	if err == nil || !strings.Contains(err.Error(), "bad config") {
+		t.Errorf("%v should contain the output of the validator", err)
+	}
+
+	// the previous file is left in place
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "test.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exepcted := "good"; string(bs) != exepcted {
+		t.Errorf("%q is not equal to %q", string(bs), exepcted)
+	}
+
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 2 {
+		t.Errorf("expected 2 files in %v, got %v", dir, len(fis))
+	}
+
+}
+
+func TestValidateOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the path is quoted and keeps the extension
+	tpl := newTpl("test", nil)
+	tpl.output = filepath.Join(dir, "it's my app.conf")
+	tpl.validate = "test -f {{output}} && case {{output}} in *.conf) ;; *) exit 1;; esac"
+
+	if err := tpl.writeFileAtomic([]byte("x")); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestCheckFormat(t *testing.T) {
+	tests := []struct {
+		output string
+		format string
+		body   string
+		err    string
+	}{
+		{"app.json", "", "{\n  \"a\": 1,\n}\n", "3: }"},
+		{"app.json", "", `{"a": 1}`, ""},
+		{"app.conf", "", "{", ""},
+		{"app.conf", "json", "{", "not valid json"},
+		{"app.json", "none", "{", ""},
+		{"app.yml", "", "a: 1\nb: [\n", "2: b: ["},
+		{"app.yaml", "", "a: 1\n---\nb: 2\n", ""},
+		{"app.toml", "", "a = 1\nb = \n", "2: b = "},
+		{"app.toml", "", "[a]\nb = \"c\"\n", ""},
+		{"app", "xml", "", "unknown format"},
+	}
+
+	for _, test := range tests {
+		tpl := newTpl("test", nil)
+		tpl.output = test.output
+		tpl.format = test.format
+
+		err := tpl.checkFormat([]byte(test.body))
+		if test.err == "" && err != nil {
+			t.Errorf("%v: %v", test.output, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%v: %v should contain %v", test.output, err, test.err)
+		}
+	}
+
+}
+
+func TestCheckFormatSchema(t *testing.T) {
+	tpl := newTpl("test", nil)
+	tpl.output = "app.yml"
+	tpl.schema = "fixtures/app.schema.json"
+
+	if err := tpl.checkFormat([]byte("port: 8080\n---\nport: 80\n")); err != nil {
+		t.Error(err)
+	}
+
+	err := tpl.checkFormat([]byte("port: 8080\n---\nport: http\n"))
+	if err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("%v should mention port", err)
+	}
+
+}
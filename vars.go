@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/imdario/mergo"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultSection string = "default"
+
+/*
+loadVars reads the YAML file (local or s3://) pointed to by
+ENTRYPOINT_VARS_FILE and returns it as the context that is passed to every
+template. The file itself is rendered as the template t, named after its
+path, first so that it can reference secrets.
+*/
+func loadVars(t tpl) (map[string]interface{}, error) {
+	path := t.name
+	src, err := readSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := t.renderStr(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[interface{}]interface{}
+	if err := yaml.Unmarshal([]byte(rendered), &m); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	return normalizeMap(m), nil
+}
+
+/*
+selectEnv returns the section of vars named env with the "default" section
+deep merged underneath it, so keys in env take precedence over defaults.
+*/
+func selectEnv(vars map[string]interface{}, env string) (map[string]interface{}, error) {
+	section, ok := vars[env].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v is not a section of the vars file", env)
+	}
+
+	if defaults, ok := vars[defaultSection].(map[string]interface{}); ok {
+		if err := mergo.Merge(&section, defaults); err != nil {
+			return nil, err
+		}
+	}
+
+	return section, nil
+}
+
+// yaml.v2 decodes mappings as map[interface{}]interface{} which sprig's
+// dict functions can't work with, so convert keys to strings recursively.
+func normalizeMap(m map[interface{}]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[fmt.Sprint(k)] = normalizeValue(v)
+	}
+
+	return out
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		return normalizeMap(v)
+	case []interface{}:
+		xs := make([]interface{}, len(v))
+		for i, e := range v {
+			xs[i] = normalizeValue(e)
+		}
+		return xs
+	default:
+		return v
+	}
+}